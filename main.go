@@ -1,58 +1,584 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"os/signal"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"syscall"
+	"time"
 
 	"github.com/tkuhlman/sitemapper/mapper"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+var (
+	includes patternList
+	excludes patternList
+	aliases  = aliasMap{}
+	headers  = headerList{}
+)
+
+func init() {
+	flag.Var(&includes, "include", "Only crawl pages whose path matches this glob, or regular expression prefixed with re:, may be repeated")
+	flag.Var(&excludes, "exclude", "Do not crawl pages whose path matches this glob, or regular expression prefixed with re:, may be repeated")
+	flag.Var(aliases, "alias", "An alias=host pair merging the alias host into the host of a site, may be repeated")
+	flag.Var(headers, "header", "A 'Name: value' header sent with each request to the crawled sites, may be repeated")
+}
+
 var (
 	workers       = flag.Uint("w", 4, "The number of worker go routines connecting to sites simultaneously")
 	listenAddress = flag.String("l", "0.0.0.0:8080", "The listen address and port for the embedded webserver")
+	userAgent     = flag.String("ua", "sitemapper", "The user-agent sent with requests and used to select the robots.txt rules")
+	ignoreRobots  = flag.Bool("ignore-robots", false, "Crawl pages disallowed by the site's robots.txt")
+	sitemapSeeds  = flag.Bool("sitemap-seeds", false, "Also crawl the pages listed in the sitemaps named in the site's robots.txt")
+	normalize     = flag.String("normalize", "", "Comma separated URL normalizations: trailing-slash, lowercase-host, default-port, slashes, encoding, index or all")
+	queryPolicy   = flag.String("query", "drop", "The query parameters kept in page URLs: drop, keep, allowlist or strip-tracking")
+	queryAllow    = flag.String("query-allow", "", "Comma separated query parameters kept with -query allowlist")
+	stayUnder     = flag.Bool("stay-under-start", false, "Only crawl pages under the directory of the starting URL")
+	subdomains    = flag.Bool("subdomains", false, "Also crawl the subdomains of each site's registrable domain, ie docs.example.com for example.com")
+	schemeReport  = flag.Bool("report-scheme-mismatch", false, "Note links using http on https pages, or https on http pages, as findings")
+	nofollow      = flag.Bool("nofollow", false, "Skip rel=nofollow links and the links on pages with a nofollow robots meta tag")
+	dirRoot       = flag.String("dir", "", "Crawl the site from the files in this directory, ie a static site build, rather than the network")
+	warcFiles     = flag.String("warc", "", "Comma separated WARC files the site is replayed from rather than the network")
+	warcRecord    = flag.String("warc-record", "", "Record every request and response to WARC files named from this prefix, ie archive/crawl")
+	warcMaxSize   = flag.Int64("warc-max-size", 1024, "The size in MB at which a new -warc-record file is started, 0 is unlimited")
+	proxyURL      = flag.String("proxy", "", "The URL of a proxy requests are sent through, defaults to the HTTP_PROXY and HTTPS_PROXY environment")
+	caFile        = flag.String("ca-file", "", "A PEM file of certificate authorities trusted along with the system's")
+	certFile      = flag.String("cert", "", "A PEM client certificate presented to servers requesting one, used with -key")
+	keyFile       = flag.String("key", "", "The PEM key of the -cert client certificate")
+	insecure      = flag.Bool("insecure", false, "Accept any server certificate, for staging sites with self-signed certificates")
+	idleConns     = flag.Int("max-idle-per-host", 0, "The idle connections kept open to each host, 0 uses the net/http default")
+	noHTTP2       = flag.Bool("disable-http2", false, "Only use HTTP/1.1")
+	reqTimeout    = flag.Duration("request-timeout", 5*time.Second, "How long each request may take, 0 is unlimited")
+	basicAuth     = flag.String("basic-auth", "", "A user:password sent as HTTP basic auth to the crawled sites")
+	bearerToken   = flag.String("bearer-token", "", "A token sent as an Authorization Bearer header to the crawled sites")
+	cookieFile    = flag.String("cookies", "", "A Netscape format cookies file, as written by curl, whose cookies are sent with requests")
+	loginURL      = flag.String("login-url", "", "A URL the -login-form is posted to before crawling, the session cookies it sets are kept")
+	loginForm     = flag.String("login-form", "", "The URL encoded form posted to -login-url, ie 'user=me&password=secret'")
+	retries       = flag.Int("retries", 2, "The number of times a page failing with a timeout, connection reset, 5xx or 429 is retried")
+	retryBackoff  = flag.Duration("retry-backoff", 500*time.Millisecond, "The wait before the first retry of a page, doubling for each one after")
+	hostRate      = flag.Float64("rate", 0, "The requests per second allowed to each host, 0 is unlimited")
+	hostConns     = flag.Int("host-connections", 0, "The requests to each host allowed in progress at once, 0 is unlimited")
+	checkExternal = flag.Bool("check-external", false, "Check the links to other sites once each without crawling them")
+	externalWork  = flag.Int("external-workers", 2, "The number of go routines checking links to other sites")
+	externalInt   = flag.Duration("external-interval", time.Second, "The minimum time between checks of links to the same other site")
+	maxDepth      = flag.Int("max-depth", 0, "Only crawl pages within this many clicks of the starting page, 0 is unlimited")
+	maxPages      = flag.Int("max-pages", 0, "Stop the crawl after this many pages are visited, 0 is unlimited")
+	crawlTimeout  = flag.Duration("timeout", 0, "Stop the crawl after this long, 0 is unlimited")
+	maxRedirects  = flag.Int("max-redirects", 10, "The number of redirects followed from a page before it is considered broken")
+	maxBroken     = flag.Int("max-broken", 0, "check mode: the number of broken pages allowed before exiting with a failure")
+	junitFile     = flag.String("junit", "", "check mode: a file to write a JUnit XML report of the crawl to")
+	sitemapDir    = flag.String("sitemap-dir", "", "A directory to write sitemaps.org XML sitemaps of the crawled pages to")
+	sitemapBase   = flag.String("sitemap-base", "", "The URL the XML sitemaps will be published at, used in a sitemap index, defaults to the site root")
+	sitemapFreq   = flag.Bool("sitemap-changefreq", false, "Include a changefreq based on click depth in the XML sitemaps")
+	sitemapPrio   = flag.Bool("sitemap-priority", false, "Include a priority based on click depth in the XML sitemaps")
+	sitemapGzip   = flag.Bool("sitemap-gzip", false, "Gzip the XML sitemaps")
+	checkpoint    = flag.String("checkpoint", "", "A file the crawl state is periodically saved to, defaults to the -resume file")
+	checkpointInt = flag.Duration("checkpoint-interval", time.Minute, "How often the crawl state is saved to the -checkpoint file")
+	seedsFile     = flag.String("seeds", "", "A file of starting URLs, one per line, for more sites crawled along with any URL arguments")
+	resume        = flag.String("resume", "", "Resume the crawl saved in this checkpoint file, the URL argument is not needed")
+	baseline      = flag.String("baseline", "", "A saved crawl to recrawl incrementally, unchanged pages are not downloaded again")
+	diffFormat    = flag.String("diff-format", "text", "diff mode: the format of the diff report, text or json")
+	diffServe     = flag.Bool("diff-serve", false, "diff mode: serve the diff from the embedded webserver rather than exiting")
 )
 
+// patternList is a repeatable flag of page path patterns.
+type patternList []*regexp.Regexp
+
+func (l *patternList) String() string {
+	var patterns []string
+	for _, re := range *l {
+		patterns = append(patterns, re.String())
+	}
+	return strings.Join(patterns, ",")
+}
+
+func (l *patternList) Set(pattern string) error {
+	re, err := mapper.ParsePattern(pattern)
+	if err != nil {
+		return err
+	}
+	*l = append(*l, re)
+	return nil
+}
+
+// headerList is a repeatable flag of request headers.
+type headerList http.Header
+
+func (h headerList) String() string {
+	var headers []string
+	for key, values := range h {
+		for _, value := range values {
+			headers = append(headers, key+": "+value)
+		}
+	}
+	return strings.Join(headers, ",")
+}
+
+func (h headerList) Set(header string) error {
+	parts := strings.SplitN(header, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("invalid header %q, want 'Name: value'", header)
+	}
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// aliasMap is a repeatable flag of alias=host pairs.
+type aliasMap map[string]string
+
+func (m aliasMap) String() string {
+	var pairs []string
+	for alias, host := range m {
+		pairs = append(pairs, alias+"="+host)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (m aliasMap) Set(pair string) error {
+	parts := strings.SplitN(pair, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid alias %q, want alias=host", pair)
+	}
+	m[parts[0]] = parts[1]
+	return nil
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [check] [flags] URL...\n", os.Args[0])
+	fmt.Fprintf(out, "       %s [check] [flags] -resume checkpoint-file\n", os.Args[0])
+	fmt.Fprintf(out, "       %s diff [flags] old-crawl-file new-crawl-file\n\n", os.Args[0])
+	fmt.Fprintln(out, "Crawls the site at URL then serves the resulting site map from an embedded webserver.")
+	fmt.Fprintln(out, "Several sites are crawled together when more than one URL is given or with -seeds.")
+	fmt.Fprintln(out, "In check mode no webserver is started, instead the broken pages are reported and the exit")
+	fmt.Fprintln(out, "status is non-zero if there are more than -max-broken of them.")
+	fmt.Fprintln(out, "In diff mode the changes between two saved crawls are reported.")
+	fmt.Fprintln(out)
+	flag.PrintDefaults()
+}
+
 func main() {
-	flag.Parse()
-	if len(flag.Args()) != 1 {
-		log.Fatal("The URL to begin the site mapping from is required and the only valid non-flag argument.")
-		// TODO better help and usage output
+	flag.Usage = usage
+	args := os.Args[1:]
+	var mode string
+	if len(args) > 0 && (args[0] == "check" || args[0] == "diff") {
+		mode, args = args[0], args[1:]
 	}
-	sm, err := mapper.NewSiteMap(flag.Arg(0), *workers)
+	flag.CommandLine.Parse(args)
+	if mode == "diff" {
+		os.Exit(runDiff())
+	}
+	var sm *mapper.SiteMap
+	var err error
+	starts, err := startURLs()
 	if err != nil {
 		log.Fatal(err)
 	}
+	switch {
+	case *resume != "" && len(starts) == 0:
+		sm, err = mapper.LoadSiteMapFile(*resume, *workers)
+		if *checkpoint == "" {
+			*checkpoint = *resume
+		}
+	case *resume == "" && len(starts) > 0:
+		sm, err = mapper.NewSiteMap(starts[0], *workers)
+		for _, start := range starts[1:] {
+			if err != nil {
+				break
+			}
+			err = sm.AddSite(start)
+		}
+	default:
+		flag.Usage()
+		log.Fatal("The URLs to begin the site mapping from are required and the only valid non-flag arguments, unless resuming.")
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	sm.CheckpointFile = *checkpoint
+	sm.CheckpointInterval = *checkpointInt
+	sm.UserAgent = *userAgent
+	sm.IgnoreRobots = *ignoreRobots
+	sm.SeedFromSitemaps = *sitemapSeeds
+	sm.MaxRedirects = *maxRedirects
+	sm.RespectNofollow = *nofollow
+	sm.Include = includes
+	sm.Exclude = excludes
+	sm.StayUnderStart = *stayUnder
+	sm.Subdomains = *subdomains
+	sm.HostAliases = aliases
+	sm.ReportSchemeMismatch = *schemeReport
+	sm.TransportOptions = mapper.TransportOptions{
+		CAFile:              *caFile,
+		CertFile:            *certFile,
+		KeyFile:             *keyFile,
+		InsecureSkipVerify:  *insecure,
+		MaxIdleConnsPerHost: *idleConns,
+		DisableHTTP2:        *noHTTP2,
+	}
+	if *proxyURL != "" {
+		if sm.TransportOptions.Proxy, err = url.Parse(*proxyURL); err != nil {
+			log.Fatalf("Invalid -proxy: %v", err)
+		}
+	}
+	sm.RequestTimeout = *reqTimeout
+	sm.WARCPrefix = *warcRecord
+	sm.WARCMaxSize = *warcMaxSize << 20
+	switch {
+	case *dirRoot != "" && *warcFiles != "":
+		flag.Usage()
+		log.Fatal("Only one of -dir and -warc can be used")
+	case *dirRoot != "":
+		sm.Fetcher = mapper.DirFetcher{Root: *dirRoot, Host: sm.URL.Host}
+	case *warcFiles != "":
+		if sm.Fetcher, err = mapper.LoadWARCFiles(strings.Split(*warcFiles, ",")...); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if len(headers) > 0 {
+		sm.Header = http.Header(headers)
+	}
+	if *basicAuth != "" {
+		parts := strings.SplitN(*basicAuth, ":", 2)
+		if len(parts) != 2 {
+			flag.Usage()
+			log.Fatal("-basic-auth must be user:password")
+		}
+		sm.Username, sm.Password = parts[0], parts[1]
+	}
+	sm.BearerToken = *bearerToken
+	sm.CookieFile = *cookieFile
+	if *loginURL != "" {
+		form, err := url.ParseQuery(*loginForm)
+		if err != nil {
+			log.Fatalf("Invalid -login-form: %v", err)
+		}
+		sm.Login = &mapper.Login{URL: *loginURL, Form: form}
+	}
+	sm.Retries = *retries
+	sm.RetryBackoff = *retryBackoff
+	sm.HostRate = *hostRate
+	sm.HostConnections = *hostConns
+	sm.CheckExternal = *checkExternal
+	sm.ExternalWorkers = *externalWork
+	sm.ExternalInterval = *externalInt
+	sm.MaxDepth = *maxDepth
+	sm.MaxPages = *maxPages
+	sm.Timeout = *crawlTimeout
+	if sm.Normalization, err = normalizer(); err != nil {
+		flag.Usage()
+		log.Fatal(err)
+	}
+	if *baseline != "" {
+		if sm.Baseline, err = mapper.LoadSiteMapFile(*baseline, *workers); err != nil {
+			log.Fatalf("Failed to load baseline crawl: %v", err)
+		}
+	}
+
+	sitemapOpts := mapper.XMLSitemapOptions{
+		BaseURL:    *sitemapBase,
+		ChangeFreq: *sitemapFreq,
+		Priority:   *sitemapPrio,
+		Gzip:       *sitemapGzip,
+	}
+
+	if mode == "check" {
+		os.Exit(runCheck(sm, sitemapOpts))
+	}
 
 	http.Handle("/metrics", prometheus.UninstrumentedHandler())
+	http.Handle("/", http.FileServer(http.Dir("./webroot/")))
+	http.Handle("/json", sm)
+	http.Handle("/crawl/", sm.CrawlHandler())
+	http.Handle("/sitemaps/", sm.XMLSitemapHandler(sitemapOpts))
+	if sm.Baseline != nil {
+		http.Handle("/diff", mapper.DiffHandler(sm.Baseline, sm))
+	}
 	go func() {
 		log.Fatal(http.ListenAndServe(*listenAddress, nil))
 	}()
+	ip, port := listenHost()
 
-	log.Printf("Crawling site %s", sm.URL)
+	log.Printf("Crawling %s, progress can be watched at http://%s:%s/", strings.Join(sm.Sites(), ", "), ip, port)
 
-	if err := sm.Start(); err != nil {
+	ctx, stop := signalContext()
+	err = sm.Start(ctx)
+	stop()
+	if err != nil {
 		log.Printf("Site crawling unfinished: %v", err)
 	}
+	logTruncated(sm)
+	logRecrawl(sm)
+	logSites(sm)
+	for _, sitemap := range sm.RobotsSitemaps() {
+		log.Printf("The site's robots.txt lists sitemap %s", sitemap)
+	}
+	if err := writeSitemaps(sm, sitemapOpts); err != nil {
+		log.Print(err)
+	}
 
-	http.Handle("/", http.FileServer(http.Dir("./webroot/")))
-	http.Handle("/json", sm)
+	log.Printf("The sitemap results are available at http://%s:%s/", ip, port)
+	waitForExit()
+}
+
+// startURLs returns the URL arguments followed by those in the -seeds file,
+// in which blank lines and lines starting with # are ignored.
+func startURLs() ([]string, error) {
+	starts := flag.Args()
+	if *seedsFile == "" {
+		return starts, nil
+	}
+	content, err := ioutil.ReadFile(*seedsFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read seeds: %v", err)
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" && !strings.HasPrefix(line, "#") {
+			starts = append(starts, line)
+		}
+	}
+	return starts, nil
+}
+
+// listenHost returns the host and port of the -l listen address for use in
+// URLs shown to the user.
+func listenHost() (string, string) {
 	listenSplit := strings.SplitN(*listenAddress, ":", 2)
 	ip := listenSplit[0]
 	if listenSplit[0] == "0.0.0.0" {
 		ip = "localhost"
 	}
-	log.Printf("The sitemap results are available at http://%s:%s/", ip, listenSplit[1])
-	log.Print("Ctrl-C will stop the results webserver and exit.")
+	return ip, listenSplit[1]
+}
 
-	// Waint for a SIGINT/SIGTERM before exit
+// signalContext returns a context cancelled by a SIGINT or SIGTERM, which
+// stops a crawl, until the returned function is called.
+func signalContext() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("Received signal %s, stopping the crawl", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
+
+// waitForExit blocks until a SIGINT/SIGTERM is received.
+func waitForExit() {
+	log.Print("Ctrl-C will stop the results webserver and exit.")
 	resultSignals := make(chan os.Signal, 2)
 	signal.Notify(resultSignals, syscall.SIGINT, syscall.SIGTERM)
 	<-resultSignals
 }
+
+// runDiff reports the changes between the two saved crawls named by the
+// arguments, either to stdout or from the embedded webserver with
+// -diff-serve. The returned exit status is non-zero if the crawls could not
+// be compared.
+func runDiff() int {
+	if len(flag.Args()) != 2 {
+		flag.Usage()
+		log.Print("diff mode requires the old and new saved crawl files as arguments.")
+		return 2
+	}
+	before, err := mapper.LoadSiteMapFile(flag.Arg(0), *workers)
+	if err != nil {
+		log.Printf("Failed to load the old crawl: %v", err)
+		return 2
+	}
+	after, err := mapper.LoadSiteMapFile(flag.Arg(1), *workers)
+	if err != nil {
+		log.Printf("Failed to load the new crawl: %v", err)
+		return 2
+	}
+
+	if *diffServe {
+		http.Handle("/", http.FileServer(http.Dir("./webroot/")))
+		http.Handle("/diff", mapper.DiffHandler(before, after))
+		go func() {
+			log.Fatal(http.ListenAndServe(*listenAddress, nil))
+		}()
+		ip, port := listenHost()
+		log.Printf("The diff of the crawls is available at http://%s:%s/diff.html", ip, port)
+		waitForExit()
+		return 0
+	}
+
+	d := mapper.Diff(before, after)
+	switch *diffFormat {
+	case "text":
+		err = mapper.WriteDiffReport(os.Stdout, d)
+	case "json":
+		err = json.NewEncoder(os.Stdout).Encode(d)
+	default:
+		log.Printf("Unknown diff format %q, must be text or json", *diffFormat)
+		return 2
+	}
+	if err != nil {
+		log.Printf("Failed to write the diff: %v", err)
+		return 2
+	}
+	return 0
+}
+
+// normalizer returns the URL normalization configured by the -normalize,
+// -query and -query-allow flags.
+func normalizer() (mapper.Normalizer, error) {
+	var n mapper.Normalizer
+	for _, option := range strings.Split(*normalize, ",") {
+		switch strings.TrimSpace(option) {
+		case "":
+		case "trailing-slash":
+			n.FoldTrailingSlash = true
+		case "lowercase-host":
+			n.LowercaseHost = true
+		case "default-port":
+			n.StripDefaultPort = true
+		case "slashes":
+			n.CollapseSlashes = true
+		case "encoding":
+			n.NormalizeEncoding = true
+		case "index":
+			n.FoldIndex = true
+		case "all":
+			n.FoldTrailingSlash, n.LowercaseHost, n.StripDefaultPort = true, true, true
+			n.CollapseSlashes, n.NormalizeEncoding, n.FoldIndex = true, true, true
+		default:
+			return n, fmt.Errorf("unknown -normalize option %q", option)
+		}
+	}
+	switch *queryPolicy {
+	case "drop":
+		n.Query = mapper.QueryDropAll
+	case "keep", "allowlist", "strip-tracking":
+		n.Query = mapper.QueryPolicy(*queryPolicy)
+	default:
+		return n, fmt.Errorf("unknown -query policy %q", *queryPolicy)
+	}
+	if *queryAllow != "" {
+		n.QueryAllow = strings.Split(*queryAllow, ",")
+	}
+	return n, nil
+}
+
+// runCheck crawls the site then reports the broken pages, and any broken
+// links to other sites, to stdout and optionally as a JUnit XML file. The
+// returned exit status is 1 if there are more than -max-broken broken pages
+// and 2 if the crawl did not finish.
+func runCheck(sm *mapper.SiteMap, sitemapOpts mapper.XMLSitemapOptions) int {
+	log.Printf("Checking %s", strings.Join(sm.Sites(), ", "))
+	ctx, stop := signalContext()
+	crawlErr := sm.Start(ctx)
+	stop()
+	logTruncated(sm)
+	logRecrawl(sm)
+	logSites(sm)
+	if err := writeSitemaps(sm, sitemapOpts); err != nil {
+		log.Print(err)
+		return 2
+	}
+
+	broken := append(sm.BrokenPages(), sm.BrokenExternalLinks()...)
+	if err := mapper.WriteBrokenReport(os.Stdout, broken); err != nil {
+		log.Printf("Failed to write the broken page report: %v", err)
+	}
+	if *junitFile != "" {
+		f, err := os.Create(*junitFile)
+		if err != nil {
+			log.Printf("Failed to create JUnit report: %v", err)
+			return 2
+		}
+		err = sm.WriteJUnit(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			log.Printf("Failed to write JUnit report %s: %v", *junitFile, err)
+			return 2
+		}
+	}
+
+	switch {
+	case crawlErr != nil:
+		log.Printf("Site crawling unfinished: %v", crawlErr)
+		return 2
+	case len(broken) > *maxBroken:
+		log.Printf("Found %d broken pages, more than the %d allowed", len(broken), *maxBroken)
+		return 1
+	}
+	return 0
+}
+
+// writeSitemaps writes the XML sitemaps for sm to the -sitemap-dir directory
+// if it was set.
+func writeSitemaps(sm *mapper.SiteMap, opts mapper.XMLSitemapOptions) error {
+	if *sitemapDir == "" {
+		return nil
+	}
+	files, err := sm.XMLSitemaps(opts)
+	if err != nil {
+		return fmt.Errorf("failed to build XML sitemaps: %v", err)
+	}
+	if err := os.MkdirAll(*sitemapDir, 0755); err != nil {
+		return fmt.Errorf("failed to create sitemap directory: %v", err)
+	}
+	for name, content := range files {
+		path := filepath.Join(*sitemapDir, name)
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			return fmt.Errorf("failed to write sitemap %s: %v", path, err)
+		}
+		log.Printf("Wrote XML sitemap %s", path)
+	}
+	return nil
+}
+
+// logTruncated logs the reason the crawl was cut short if it reached one of
+// the -max-depth, -max-pages or -timeout limits.
+func logTruncated(sm *mapper.SiteMap) {
+	if reason := sm.Truncated(); reason != "" {
+		log.Printf("The crawl was truncated, %s", reason)
+	}
+}
+
+// logSites logs the page counts of each site when more than one was crawled.
+func logSites(sm *mapper.SiteMap) {
+	summaries := sm.SiteSummaries()
+	if len(summaries) < 2 {
+		return
+	}
+	for _, s := range summaries {
+		log.Printf("Site %s has %d pages, %d visited and %d broken", s.Host, s.Pages, s.Visited, s.Broken)
+	}
+}
+
+// logRecrawl logs a summary of the changes since the -baseline crawl if there
+// was one.
+func logRecrawl(sm *mapper.SiteMap) {
+	summary := sm.RecrawlSummary()
+	if summary == nil {
+		return
+	}
+	log.Printf("Since the baseline crawl %d pages were added, %d removed, %d changed and %d unchanged",
+		len(summary.Added), len(summary.Removed), len(summary.Changed), len(summary.Unchanged))
+}
@@ -0,0 +1,179 @@
+package mapper
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// Login is a form posted before crawling begins, the session cookies it sets
+// are sent with the requests of the crawl.
+type Login struct {
+	URL  string
+	Form url.Values
+}
+
+// newJar returns an empty cookie jar using the public suffix list.
+func newJar() http.CookieJar {
+	// cookiejar.New only fails with invalid options
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	return jar
+}
+
+// session sets up the cookies and authentication of c for the crawl of sm,
+// reading sm.CookieFile and posting sm.Login.
+func (sm *SiteMap) session(c *crawler) error {
+	c.header = sm.Header
+	c.username, c.password = sm.Username, sm.Password
+	c.bearerToken = sm.BearerToken
+	if sm.CookieFile == "" && sm.Login == nil {
+		return nil
+	}
+
+	jar := newJar()
+	c.client.Jar = jar
+	c.externalClient.Jar = jar
+	if sm.CookieFile != "" {
+		f, err := os.Open(sm.CookieFile)
+		if err != nil {
+			return err
+		}
+		err = loadCookies(jar, f)
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read cookies from %s: %v", sm.CookieFile, err)
+		}
+	}
+	if sm.Login != nil {
+		if err := c.login(sm.Login); err != nil {
+			return fmt.Errorf("login to %s failed: %v", sm.Login.URL, err)
+		}
+	}
+	return nil
+}
+
+// loadCookies adds the cookies of a Netscape format cookies file, as written
+// by curl and browser extensions, to jar. Each line is the tab separated
+// domain, whether subdomains are included, path, whether the cookie is
+// secure, expiry as a Unix time, name and value. Lines starting with # are
+// comments except for the #HttpOnly_ prefix on the domain of a cookie.
+func loadCookies(jar http.CookieJar, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, "#HttpOnly_")
+		if httpOnly {
+			line = strings.TrimPrefix(line, "#HttpOnly_")
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return fmt.Errorf("line %d: want 7 tab separated fields, got %d", n, len(fields))
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return fmt.Errorf("line %d: invalid expiry %q", n, fields[4])
+		}
+
+		host := strings.TrimPrefix(fields[0], ".")
+		cookie := &http.Cookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(fields[1], "TRUE") {
+			cookie.Domain = host
+		}
+		if expires > 0 {
+			cookie.Expires = time.Unix(expires, 0)
+		}
+		u := &url.URL{Scheme: "http", Host: host, Path: "/"}
+		if cookie.Secure {
+			u.Scheme = "https"
+		}
+		jar.SetCookies(u, []*http.Cookie{cookie})
+	}
+	return scanner.Err()
+}
+
+// login posts the form of l, following any redirects, so that the session
+// cookies it sets are kept in the jar of c.client. A final status other than
+// 2XX is an error.
+func (c *crawler) login(l *Login) error {
+	req, err := http.NewRequestWithContext(c.context(), http.MethodPost, l.URL, strings.NewReader(l.Form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	c.authorize(req)
+	resp, err := c.externalClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// externalRedirect is the redirect policy of c.externalClient, following up
+// to 10 redirects as the default policy does. The extra headers and
+// credentials of c are removed from a redirect to a host other than the
+// crawled sites.
+func (c *crawler) externalRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= 10 {
+		return errors.New("stopped after 10 redirects")
+	}
+	if !c.onSites(req.URL) {
+		for key := range c.header {
+			req.Header.Del(key)
+		}
+		req.Header.Del("Authorization")
+	}
+	return nil
+}
+
+// onSites reports if u is on one of the crawled sites, always true when
+// c.sites is not set.
+func (c *crawler) onSites(u *url.URL) bool {
+	return c.sites == nil || c.sites.site(c.sites.host(u, c.normalizer)) >= 0
+}
+
+// authorize adds the user-agent to req and, if it is to one of the crawled
+// sites, the extra headers and credentials of c. Requests to other sites
+// never get the credentials.
+func (c *crawler) authorize(req *http.Request) {
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	if !c.onSites(req.URL) {
+		return
+	}
+	for key, values := range c.header {
+		req.Header.Del(key)
+		for _, value := range values {
+			req.Header.Add(key, value)
+		}
+	}
+	switch {
+	case c.bearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+c.bearerToken)
+	case c.username != "" || c.password != "":
+		req.SetBasicAuth(c.username, c.password)
+	}
+}
@@ -0,0 +1,236 @@
+package mapper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestLoadCookies(t *testing.T) {
+	file := strings.Join([]string{
+		"# Netscape HTTP Cookie File",
+		"",
+		".example.com\tTRUE\t/\tFALSE\t0\tsession\tabc",
+		"#HttpOnly_secure.example.com\tFALSE\t/\tTRUE\t4102444800\ttoken\txyz",
+		"other.com\tFALSE\t/private\tFALSE\t0\tid\t1",
+	}, "\n")
+	jar := newJar()
+	if err := loadCookies(jar, strings.NewReader(file)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"http://example.com/", "session=abc"},
+		{"http://www.example.com/page", "session=abc"},
+		{"http://secure.example.com/", "session=abc"},
+		{"https://secure.example.com/", "session=abc; token=xyz"},
+		{"http://other.com/", ""},
+		{"http://other.com/private/page", "id=1"},
+		{"http://sub.other.com/private/page", ""},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, c := range jar.Cookies(u) {
+			got = append(got, c.String())
+		}
+		if strings.Join(got, "; ") != test.want {
+			t.Errorf("URL %s got cookies %q, want %q", test.url, strings.Join(got, "; "), test.want)
+		}
+	}
+
+	if err := loadCookies(newJar(), strings.NewReader("example.com\tTRUE\t/")); err == nil {
+		t.Error("No error for a line with too few fields")
+	}
+}
+
+func TestStartAuthentication(t *testing.T) {
+	var mu sync.Mutex
+	var leaked []string
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "" || r.Header.Get("X-Api-Key") != "" {
+			leaked = append(leaked, r.URL.Path)
+		}
+	}))
+	defer external.Close()
+
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, password, ok := r.BasicAuth(); !ok || user != "me" || password != "secret" || r.Header.Get("X-Api-Key") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `<a href="/private">private</a><a href="%s/elsewhere">elsewhere</a>`, external.URL)
+		case "/private":
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	sm, err := NewSiteMap(site.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Username, sm.Password = "me", "secret"
+	sm.Header = http.Header{"X-Api-Key": []string{"key"}}
+	sm.CheckExternal = true
+	sm.ExternalInterval = 0
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if broken := sm.BrokenPages(); len(broken) > 0 {
+		t.Errorf("Got broken pages %+v", broken)
+	}
+	if p := sm.pages["/private"]; p == nil || !p.visited {
+		t.Error("Page /private not visited")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(leaked) > 0 {
+		t.Errorf("Credentials sent to another site for %v", leaked)
+	}
+}
+
+func TestStartLogin(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			if r.Method != http.MethodPost || r.FormValue("user") != "me" || r.FormValue("password") != "secret" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "logged-in", Path: "/"})
+			http.Redirect(w, r, "/", http.StatusSeeOther)
+			return
+		case "/robots.txt":
+			http.NotFound(w, r)
+			return
+		}
+		if c, err := r.Cookie("session"); err != nil || c.Value != "logged-in" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.URL.Path == "/" {
+			fmt.Fprint(w, `<a href="/account">account</a>`)
+		}
+	}))
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Login = &Login{URL: server.URL + "/login", Form: url.Values{"user": {"me"}, "password": {"wrong"}}}
+	if err := sm.Start(context.Background()); err == nil {
+		t.Error("No error from Start with a failed login")
+	}
+	if got, want := sm.state, stateStopped; got != want {
+		t.Errorf("Got state %q after a failed login, want %q", got, want)
+	}
+
+	sm.Login.Form.Set("password", "secret")
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if broken := sm.BrokenPages(); len(broken) > 0 {
+		t.Errorf("Got broken pages %+v", broken)
+	}
+	if p := sm.pages["/account"]; p == nil || !p.visited {
+		t.Error("Page /account not visited after logging in")
+	}
+}
+
+func TestStartLoginRedirect(t *testing.T) {
+	var mu sync.Mutex
+	var leaked []string
+	landing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		for _, key := range []string{"Authorization", "X-Api-Key"} {
+			if r.Header.Get(key) != "" {
+				leaked = append(leaked, key)
+			}
+		}
+	}))
+	defer landing.Close()
+
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/login":
+			http.Redirect(w, r, landing.URL+"/welcome", http.StatusSeeOther)
+		case "/robots.txt":
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	sm, err := NewSiteMap(site.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.BearerToken = "token"
+	sm.Header = http.Header{"X-Api-Key": []string{"key"}}
+	sm.Login = &Login{URL: site.URL + "/login", Form: url.Values{"user": {"me"}}}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(leaked) > 0 {
+		t.Errorf("Login redirect to another site sent %v", leaked)
+	}
+}
+
+func TestStartCookieFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "abc" {
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "cookies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	u, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := filepath.Join(dir, "cookies.txt")
+	cookies := fmt.Sprintf("%s\tFALSE\t/\tFALSE\t0\tsession\tabc\n", u.Hostname())
+	if err := ioutil.WriteFile(name, []byte(cookies), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sm, err := NewSiteMap(server.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.CookieFile = name
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if broken := sm.BrokenPages(); len(broken) > 0 {
+		t.Errorf("Got broken pages %+v", broken)
+	}
+}
@@ -1,105 +1,544 @@
 package mapper
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync"
 	"time"
+	"unicode"
 
 	"golang.org/x/net/html"
 )
 
-const clientTimeout = 5 * time.Second
+const (
+	clientTimeout       = 5 * time.Second
+	defaultMaxRedirects = 10
+)
+
+// recordedHeaders are the response headers stored with each page.
+var recordedHeaders = []string{"Content-Type", "Content-Length", "Last-Modified", "ETag", "Cache-Control"}
+
+// errOffSite is returned by crawler.get when a redirect leads to another host.
+var errOffSite = errors.New("redirected off site")
 
 type crawler struct {
-	client       *http.Client
-	stopChannels []chan bool
+	baseline    map[string]*page // pages from a previous crawl keyed by URL
+	bearerToken string
+	client      *http.Client
+	ctx         context.Context // cancelling stops the crawling go routines and their requests, nil never cancels
+	// external records links to other sites on each page, they are checked
+	// with externalClient which follows redirects.
+	external         bool
+	externalClient   *http.Client
+	externalThrottle *hostThrottle
+	header           http.Header  // extra headers sent to the crawled sites
+	limiter          *hostLimiter // the per host politeness limits, nil for none
+	maxRedirects     int
+	nofollow         bool // skip nofollow links
+	normalizer       *Normalizer
+	password         string
+	pauser           *pauser // holds the crawling go routines while paused
+	retries          int     // times a page failing with a transient error is visited again
+	retryBackoff     time.Duration
+	schemes          bool       // report links using a different scheme than their page
+	sites            *siteHosts // the sites links are followed to, nil for only the host of each page
+	userAgent        string
+	username         string      // basic auth credentials sent to the crawled sites when set
+	warc             *warcWriter // records each request and response when set
+	workers          sync.WaitGroup
 }
 
-// newCrawler returns a crawler using the default http client with a faster
-// timeout.
+// newCrawler returns a crawler using an http client with a faster timeout
+// which leaves redirects to be followed by the crawler.
 func newCrawler() *crawler {
-	c := http.DefaultClient
-	c.Timeout = clientTimeout
-	return &crawler{client: c}
+	c := &http.Client{
+		Timeout: clientTimeout,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	cr := &crawler{
+		client:         c,
+		externalClient: &http.Client{Timeout: clientTimeout},
+		limiter:        &hostLimiter{},
+		maxRedirects:   defaultMaxRedirects,
+	}
+	cr.externalClient.CheckRedirect = cr.externalRedirect
+	return cr
 }
 
 // crawl start a go routine that pulls pages from the new channel visits them
-// and puts the result onto the finished channel. c.stop will halt all of the
-// go routines.
+// and puts the result onto the finished channel. Cancelling c.ctx halts all of
+// the go routines, c.wait blocks until they have returned. While c.pauser is
+// paused each go routine waits with the page it has taken before visiting it.
 func (c *crawler) crawl(new <-chan *page, finished chan<- *page) {
-	stop := make(chan bool, 1)
-	c.stopChannels = append(c.stopChannels, stop)
+	ctx := c.context()
+	c.workers.Add(1)
 	go func() {
+		defer c.workers.Done()
 		for {
 			select {
-			case <-stop:
+			case <-ctx.Done():
 				return
 			case p := <-new:
-				c.visit(p)
-				// TODO consider adding a histogram for stats on visit timing
-				finished <- p
+				c.pauser.wait(ctx)
+				if ctx.Err() != nil {
+					return
+				}
+				c.visitRetrying(ctx, p)
+				if ctx.Err() != nil {
+					return
+				}
+				select {
+				case finished <- p:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
 	}()
 }
 
-// get issues an HTTP GET to the given URL using the crawler client. Any
-// non-2XX status codes are considered an error. The body of the response
-// is returned on success.
-func (c *crawler) get(url string) (io.ReadCloser, error) {
-	resp, err := c.client.Get(url)
+// context returns c.ctx or, if it is not set, a context never cancelled.
+func (c *crawler) context() context.Context {
+	if c.ctx == nil {
+		return context.Background()
+	}
+	return c.ctx
+}
+
+// get issues an HTTP GET to the given URL using the crawler client, following
+// up to c.maxRedirects redirects on the same host. Each redirect followed is
+// returned along with the final response. Any non-2XX final status code,
+// redirect loop or redirect chain longer than c.maxRedirects is considered an
+// error, a redirect to a different host stops with errOffSite. The body of
+// the final response is only left open when the error is nil.
+func (c *crawler) get(rawURL string) (*http.Response, []redirect, error) {
+	return c.fetch(http.MethodGet, rawURL, nil)
+}
+
+// fetch implements get using the given method and adding header to the
+// initial request. This allows for conditional requests so a 304 Not
+// Modified response to the initial request is not an error when header is
+// set.
+func (c *crawler) fetch(method, rawURL string, header http.Header) (*http.Response, []redirect, error) {
+	target, err := url.Parse(rawURL)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	if resp.StatusCode < 200 || resp.StatusCode > 299 {
-		return nil, fmt.Errorf("Status code %d", resp.StatusCode)
+	var hops []redirect
+	seen := map[string]bool{}
+	for {
+		seen[target.String()] = true
+		req, err := http.NewRequestWithContext(c.context(), method, target.String(), nil)
+		if err != nil {
+			return nil, hops, err
+		}
+		if len(hops) == 0 {
+			for key, values := range header {
+				req.Header[key] = values
+			}
+		}
+		c.authorize(req)
+		resp, err := c.do(req)
+		if err != nil {
+			return nil, hops, err
+		}
+		if len(hops) == 0 && header != nil && resp.StatusCode == http.StatusNotModified {
+			resp.Body.Close()
+			return resp, hops, nil
+		}
+		if !isRedirect(resp.StatusCode) {
+			if resp.StatusCode < 200 || resp.StatusCode > 299 {
+				resp.Body.Close()
+				return resp, hops, fmt.Errorf("Status code %d", resp.StatusCode)
+			}
+			return resp, hops, nil
+		}
+
+		resp.Body.Close()
+		location := resp.Header.Get("Location")
+		next, err := target.Parse(location)
+		if location == "" || err != nil {
+			return resp, hops, parseError{fmt.Errorf("Status code %d with invalid Location %q", resp.StatusCode, location)}
+		}
+		next.Fragment = ""
+		hops = append(hops, redirect{StatusCode: resp.StatusCode, URL: target.String(), Location: next.String()})
+		switch {
+		case !c.sameHost(next, target):
+			return resp, hops, errOffSite
+		case seen[next.String()]:
+			return resp, hops, fmt.Errorf("redirect loop back to %s", next)
+		case len(hops) > c.maxRedirects:
+			return resp, hops, fmt.Errorf("redirect chain longer than %d hops", c.maxRedirects)
+		}
+		target = next
 	}
+}
 
-	return resp.Body, nil
+// sameHost reports if a and b are on the same host once merged by the
+// aliases of c.sites.
+func (c *crawler) sameHost(a, b *url.URL) bool {
+	if c.sites == nil {
+		return c.normalizer.host(a) == c.normalizer.host(b)
+	}
+	return c.sites.host(a, c.normalizer) == c.sites.host(b, c.normalizer)
 }
 
-// stop sends a signal to each go routine doing crawling to stop any activity.
-func (c *crawler) stop() {
-	for _, c := range c.stopChannels {
-		c <- true
+// isRedirect reports if the status code is an HTTP redirect with a Location.
+func isRedirect(statusCode int) bool {
+	switch statusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
 	}
+	return false
+}
+
+// wait blocks until each go routine doing crawling has returned after c.ctx
+// is cancelled.
+func (c *crawler) wait() {
+	c.workers.Wait()
 }
 
 // Crawler connects to the page and extract all the links populating p.Links.
 // Any non-200 response code will result in p.Broken being set to true.
+// Redirects are recorded on p rather than parsed for links, the target being
+// added to the site as its own page. The status code, headers of interest,
+// body size and fetch duration are recorded on p. For pages in the baseline
+// crawl a conditional request is made, reusing the previous links when the
+// page is not modified. Resources are checked with a HEAD request, falling
+// back to GET if the server does not allow HEAD, and are never parsed. Links
+// are resolved against the page's <base href> if it has one.
 func (c *crawler) visit(p *page) {
+	p.reset()
 	p.visited = true
-	body, err := c.get(p.url.String())
-	if err != nil {
+	start := time.Now()
+	defer func() {
+		p.duration = time.Since(start)
+		fetchDuration.Observe(p.duration.Seconds())
+	}()
+
+	prev := c.baseline[p.url.String()]
+	method := http.MethodGet
+	if p.resource {
+		method = http.MethodHead
+	}
+	resp, hops, err := c.fetch(method, p.url.String(), prev.conditionalHeader())
+	if method == http.MethodHead && resp != nil &&
+		(resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp, hops, err = c.fetch(http.MethodGet, p.url.String(), prev.conditionalHeader())
+	}
+	if err == nil && resp.StatusCode == http.StatusNotModified {
+		p.notModified(prev, resp.Header)
+		return
+	}
+	p.redirects = hops
+	if len(hops) > 0 {
+		p.status = hops[0].StatusCode
+		p.finalURL, _ = url.Parse(hops[len(hops)-1].Location)
+	} else if resp != nil {
+		p.status = resp.StatusCode
+		p.header = recordHeaders(resp.Header)
+	}
+	// A redirect back to the same page once normalized, such as one adding a
+	// trailing slash, is parsed as the page itself.
+	selfRedirect := len(hops) > 0 && err == nil && c.normalizer.key(p.finalURL) == c.normalizer.key(p.url)
+	if selfRedirect {
+		p.header = recordHeaders(resp.Header)
+	}
+	switch {
+	case err == errOffSite:
+		if target, ok := p.filterLink(p.finalURL.String(), c.normalizer, c.sites); ok {
+			p.redirect = target // to another of the sites crawled
+			return
+		}
+		p.findings = append(p.findings, fmt.Sprintf("redirects off site to %s", p.finalURL))
+		return
+	case len(hops) > 0 && resp != nil && !isRedirect(resp.StatusCode) && !selfRedirect:
+		if err == nil {
+			resp.Body.Close()
+		}
+		if target, ok := p.filterLink(p.finalURL.String(), c.normalizer, c.sites); ok {
+			p.redirect = target
+		}
+		return
+	case err != nil:
 		p.broken = true
 		p.err = err
+		p.errClass = classifyError(err, resp)
+		p.retry = transient(p.errClass, resp)
+		return
+	}
+
+	if p.resource {
+		resp.Body.Close()
+		return
+	}
+	body := &countingReader{ReadCloser: resp.Body}
+	doc := extractLinks(body, c.nofollow)
+	if body.err != nil {
+		p.broken = true
+		p.err = readError{body.err}
+		p.errClass = errorBodyRead
+		p.retry = true
 		return
 	}
+	base := p.url
+	if p.finalURL != nil {
+		base = p.finalURL
+	}
+	if doc.base != "" {
+		if u, err := base.Parse(doc.base); err == nil {
+			base = u
+		}
+	}
+	mismatched := 0 // links to the sites using the other of http and https
+	for _, l := range doc.links {
+		if u, err := base.Parse(l.url); err == nil {
+			l.url = u.String()
+			if external, ok := p.externalLink(l.url, c.normalizer, c.sites); c.external && ok {
+				p.external[external]++
+				continue
+			}
+			if c.schemes && u.Scheme != p.url.Scheme && (u.Scheme == "http" || u.Scheme == "https") {
+				if _, ok := p.filterLink(l.url, c.normalizer, c.sites); ok {
+					mismatched++
+				}
+			}
+		}
+		p.addLink(l, c.normalizer, c.sites)
+	}
+	if mismatched > 0 {
+		p.findings = append(p.findings, fmt.Sprintf("links with a different scheme than %s: %d", p.url.Scheme, mismatched))
+	}
+	if doc.canonical != "" {
+		if u, err := base.Parse(doc.canonical); err == nil {
+			u.Fragment = ""
+			p.canonical = u.String()
+		}
+		if p.nonCanonical(c.normalizer, c.sites) {
+			p.findings = append(p.findings, fmt.Sprintf("canonical URL is %s", p.canonical))
+		}
+	}
+	p.size = body.n
+	responseSize.Observe(float64(body.n))
+}
+
+// recordHeaders returns a copy of the response headers of interest which
+// are stored with a page.
+func recordHeaders(header http.Header) http.Header {
+	recorded := http.Header{}
+	for _, key := range recordedHeaders {
+		if value := header.Get(key); value != "" {
+			recorded.Set(key, value)
+		}
+	}
+	return recorded
+}
 
-	p.addLinks(extractLinks(body))
+// countingReader counts the bytes read through it and records the first
+// error other than io.EOF.
+type countingReader struct {
+	io.ReadCloser
+	err error
+	n   int64
+}
+
+func (r *countingReader) Read(b []byte) (int, error) {
+	n, err := r.ReadCloser.Read(b)
+	r.n += int64(n)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
 }
 
-// extractLinks parses an html page and returns the href for all of the
-// anchor tags.
-func extractLinks(body io.ReadCloser) []string {
+// document is the result of parsing an html page with extractLinks.
+type document struct {
+	base      string // the href of the <base> tag, relative links are resolved against it
+	canonical string // the href of the rel=canonical link
+	links     []link
+}
+
+// extractLinks parses an html page and returns the links to other pages and
+// resources found in it, each tagged with its kind, along with the base and
+// canonical URLs the page declares. When nofollow is set links marked
+// rel=nofollow are skipped, as are all links on a page with a robots meta
+// tag containing nofollow.
+func extractLinks(body io.ReadCloser, nofollow bool) document {
 	defer body.Close()
-	var links []string
+	var doc document
+	follow := true
 	tokens := html.NewTokenizer(body)
 	for {
 		tt := tokens.Next()
 		switch tt {
 		case html.ErrorToken:
-			return links
-		case html.StartTagToken:
+			return doc
+		case html.StartTagToken, html.SelfClosingTagToken:
 			token := tokens.Token()
-			if token.Data == "a" {
-				for _, a := range token.Attr {
-					if a.Key == "href" {
-						links = append(links, a.Val)
-					}
+			attrs := map[string]string{}
+			for _, a := range token.Attr {
+				attrs[a.Key] = a.Val
+			}
+			switch {
+			case token.Data == "base" && doc.base == "":
+				doc.base = strings.TrimSpace(attrs["href"])
+			case token.Data == "link" && hasToken(attrs["rel"], "canonical") && doc.canonical == "":
+				doc.canonical = strings.TrimSpace(attrs["href"])
+			case token.Data == "meta" && strings.EqualFold(attrs["name"], "robots") && hasToken(attrs["content"], "nofollow"):
+				if nofollow {
+					follow = false
+					doc.links = nil
 				}
 			}
+			if !follow || (nofollow && hasToken(attrs["rel"], "nofollow")) {
+				continue
+			}
+			doc.links = append(doc.links, tagLinks(token.Data, attrs)...)
+		}
+	}
+}
+
+// hasToken reports if the space or comma separated list contains token,
+// ignoring case.
+func hasToken(list, token string) bool {
+	for _, value := range strings.FieldsFunc(list, func(r rune) bool { return r == ',' || unicode.IsSpace(r) }) {
+		if strings.EqualFold(value, token) {
+			return true
+		}
+	}
+	return false
+}
+
+// tagLinks returns the links from a single html tag with the given
+// attributes.
+func tagLinks(tag string, attrs map[string]string) []link {
+	var links []link
+	add := func(kind, attr string) {
+		if value, ok := attrs[attr]; ok && strings.TrimSpace(value) != "" {
+			links = append(links, link{url: strings.TrimSpace(value), kind: kind})
+		}
+	}
+	switch tag {
+	case "a":
+		add(linkAnchor, "href")
+	case "img":
+		add(linkImage, "src")
+		links = append(links, srcsetLinks(attrs["srcset"])...)
+	case "link":
+		if kind := relKind(attrs["rel"]); kind != "" {
+			add(kind, "href")
+		}
+	case "script":
+		add(linkScript, "src")
+	case "iframe":
+		add(linkIframe, "src")
+	case "form":
+		add(linkForm, "action")
+	case "video", "audio":
+		add(linkMedia, "src")
+	case "source":
+		add(linkMedia, "src")
+		links = append(links, srcsetLinks(attrs["srcset"])...)
+	case "meta":
+		if strings.EqualFold(attrs["http-equiv"], "refresh") {
+			if target := refreshURL(attrs["content"]); target != "" {
+				links = append(links, link{url: target, kind: linkRefresh})
+			}
+		}
+	}
+	return links
+}
+
+// relKind returns the link kind for a <link> tag with the given rel
+// attribute, an empty string if it does not refer to a page or resource.
+func relKind(rel string) string {
+	switch {
+	case hasToken(rel, "stylesheet"):
+		return linkStylesheet
+	case hasToken(rel, "icon") || hasToken(rel, "apple-touch-icon"):
+		return linkIcon
+	case hasToken(rel, "preload") || hasToken(rel, "modulepreload") || hasToken(rel, "prefetch"):
+		return linkPreload
+	case hasToken(rel, "canonical"):
+		return linkCanonical
+	case hasToken(rel, "alternate"):
+		return linkAlternate
+	}
+	return ""
+}
+
+// srcsetLinks returns the image URLs from a srcset attribute, a comma
+// separated list of URLs each optionally followed by a descriptor.
+func srcsetLinks(srcset string) []link {
+	var links []link
+	for _, candidate := range strings.Split(srcset, ",") {
+		if fields := strings.Fields(candidate); len(fields) > 0 {
+			links = append(links, link{url: fields[0], kind: linkImage})
 		}
 	}
+	return links
+}
+
+// refreshURL returns the URL from the content of a meta refresh tag such as
+// "5; url=/next", an empty string if there is none.
+func refreshURL(content string) string {
+	i := strings.IndexAny(content, ";,")
+	if i < 0 {
+		return ""
+	}
+	target := strings.TrimSpace(content[i+1:])
+	if len(target) < 4 || !strings.EqualFold(target[:4], "url=") {
+		return ""
+	}
+	return strings.Trim(strings.TrimSpace(target[4:]), `'"`)
+}
+
+// throttle enforces a minimum interval between requests shared by all of the
+// crawling go routines. A nil throttle never waits.
+type throttle struct {
+	interval time.Duration
+	mu       sync.Mutex
+	next     time.Time
+}
+
+// wait blocks until the next request slot is available or ctx is done.
+func (t *throttle) wait(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	if t.interval <= 0 {
+		t.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if t.next.Before(now) {
+		t.next = now
+	}
+	delay := t.next.Sub(now)
+	t.next = t.next.Add(t.interval)
+	t.mu.Unlock()
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// lengthen raises the interval of t to interval if it is longer.
+func (t *throttle) lengthen(interval time.Duration) {
+	t.mu.Lock()
+	if interval > t.interval {
+		t.interval = interval
+	}
+	t.mu.Unlock()
 }
@@ -1,11 +1,15 @@
 package mapper
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 )
@@ -14,7 +18,7 @@ func TestCrawl(t *testing.T) {
 	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
 	defer server.Close()
 
-	u, err := url.Parse(server.URL + "hello-world")
+	u, err := url.Parse(server.URL + "/hello-world")
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -25,12 +29,14 @@ func TestCrawl(t *testing.T) {
 
 	new <- p
 
+	ctx, cancel := context.WithCancel(context.Background())
 	c := newCrawler()
+	c.ctx = ctx
 	c.crawl(new, finished)
-	time.Sleep(10 * time.Millisecond) // needed because I block on finished below
-	c.stop()
-
 	got := <-finished
+	cancel()
+	c.wait()
+
 	if got.url != p.url {
 		t.Errorf("Got url %q, want %q", got.url, p.url)
 	}
@@ -40,14 +46,16 @@ func TestCrawl(t *testing.T) {
 }
 
 func TestExtractLinks(t *testing.T) {
-	wantLinks := []string{
-		"./",
-		"http://play.golang.org/p/2C7wwJ6nxG",
-		"values",
-		"https://twitter.com/mmcgrana",
-		"mailto:mmcgrana@gmail.com",
-		"https://github.com/mmcgrana/gobyexample/blob/master/examples/hello-world",
-		"https://github.com/mmcgrana/gobyexample#license",
+	wantLinks := []link{
+		{"site.css", linkStylesheet},
+		{"./", linkAnchor},
+		{"http://play.golang.org/p/2C7wwJ6nxG", linkAnchor},
+		{"play.png", linkImage},
+		{"values", linkAnchor},
+		{"https://twitter.com/mmcgrana", linkAnchor},
+		{"mailto:mmcgrana@gmail.com", linkAnchor},
+		{"https://github.com/mmcgrana/gobyexample/blob/master/examples/hello-world", linkAnchor},
+		{"https://github.com/mmcgrana/gobyexample#license", linkAnchor},
 	}
 
 	f, err := os.Open("testdata/hello-world")
@@ -55,13 +63,118 @@ func TestExtractLinks(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	links := extractLinks(f)
+	links := extractLinks(f, false).links
+
+	if !reflect.DeepEqual(links, wantLinks) {
+		t.Errorf("Got links\n%v\nwant links\n%v\n", links, wantLinks)
+	}
 
+	doc := `<html><head>
+<link rel="icon" href="/favicon.ico"><link rel="canonical" href="/page"><link rel="alternate stylesheet" href="/alt.css">
+<link rel="alternate" hreflang="fr" href="/fr/page"><link rel="preload" href="/font.woff2"><link rel="dns-prefetch" href="//cdn">
+<meta http-equiv="Refresh" content="5; URL='/next'"><meta http-equiv="refresh" content="5">
+<script src="/app.js"></script><script>var inline;</script>
+</head><body>
+<img src="/a.png" srcset="/a-2x.png 2x, /a-3x.png 3x"/>
+<picture><source srcset="/b.webp 1x, /b-2x.webp 2x"></picture>
+<video src="/movie.mp4"><source src="/movie.webm"></video><audio src="/sound.mp3"></audio>
+<iframe src="/embed"></iframe><form action="/search"></form><form></form>
+</body></html>`
+	wantLinks = []link{
+		{"/favicon.ico", linkIcon},
+		{"/page", linkCanonical},
+		{"/alt.css", linkStylesheet},
+		{"/fr/page", linkAlternate},
+		{"/font.woff2", linkPreload},
+		{"/next", linkRefresh},
+		{"/app.js", linkScript},
+		{"/a.png", linkImage},
+		{"/a-2x.png", linkImage},
+		{"/a-3x.png", linkImage},
+		{"/b.webp", linkImage},
+		{"/b-2x.webp", linkImage},
+		{"/movie.mp4", linkMedia},
+		{"/movie.webm", linkMedia},
+		{"/sound.mp3", linkMedia},
+		{"/embed", linkIframe},
+		{"/search", linkForm},
+	}
+	links = extractLinks(ioutil.NopCloser(strings.NewReader(doc)), false).links
 	if !reflect.DeepEqual(links, wantLinks) {
 		t.Errorf("Got links\n%v\nwant links\n%v\n", links, wantLinks)
 	}
 }
 
+func TestExtractLinksNofollow(t *testing.T) {
+	doc := `<html><head><base href="/docs/"><base href="/ignored/"><link rel="canonical" href="/docs/page"></head>
+<body><a href="a">a</a><a rel="nofollow ugc" href="b">b</a></body></html>`
+	tests := []struct {
+		doc       string
+		nofollow  bool
+		wantLinks []link
+	}{
+		{
+			doc:       doc,
+			wantLinks: []link{{"/docs/page", linkCanonical}, {"a", linkAnchor}, {"b", linkAnchor}},
+		},
+		{
+			doc:       doc,
+			nofollow:  true,
+			wantLinks: []link{{"/docs/page", linkCanonical}, {"a", linkAnchor}},
+		},
+		{
+			doc:      `<a href="a">a</a><meta name="ROBOTS" content="noindex,nofollow"><a href="b">b</a>`,
+			nofollow: true,
+		},
+	}
+	for i, test := range tests {
+		got := extractLinks(ioutil.NopCloser(strings.NewReader(test.doc)), test.nofollow)
+		if !reflect.DeepEqual(got.links, test.wantLinks) {
+			t.Errorf("Test %d - got links %v, want %v", i, got.links, test.wantLinks)
+		}
+	}
+	got := extractLinks(ioutil.NopCloser(strings.NewReader(doc)), false)
+	if got.base != "/docs/" || got.canonical != "/docs/page" {
+		t.Errorf("Got base %q and canonical %q", got.base, got.canonical)
+	}
+}
+
+func TestVisitBase(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/cms/page":
+			fmt.Fprint(w, `<base href="/docs/"><link rel="canonical" href="/docs/page"><a href="other">other</a>`)
+		case "/docs/page":
+			fmt.Fprint(w, `<link rel="canonical" href="https://`+r.Host+`/docs/page#top">`)
+		}
+	}))
+	defer server.Close()
+
+	c := newCrawler()
+	u, err := url.Parse(server.URL + "/cms/page")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPage(u)
+	c.visit(p)
+	if want := map[string]int{"/docs/other": 1, "/docs/page": 1}; !reflect.DeepEqual(p.links, want) {
+		t.Errorf("Got links %v, want %v", p.links, want)
+	}
+	if want := server.URL + "/docs/page"; p.canonical != want || !p.nonCanonical(nil, nil) {
+		t.Errorf("Got canonical %q non-canonical %t, want %q", p.canonical, p.nonCanonical(nil, nil), want)
+	}
+	if len(p.findings) != 1 {
+		t.Errorf("Got findings %v for a non-canonical page", p.findings)
+	}
+
+	p = newPage(u.ResolveReference(&url.URL{Path: "/docs/page"}))
+	c.visit(p)
+	if p.nonCanonical(nil, nil) || len(p.findings) != 0 {
+		t.Errorf("Canonical page got canonical %q and findings %v", p.canonical, p.findings)
+	}
+}
+
 func TestGet(t *testing.T) {
 	tests := []struct {
 		path    string
@@ -82,7 +195,7 @@ func TestGet(t *testing.T) {
 	c := newCrawler()
 
 	for _, test := range tests {
-		body, err := c.get(server.URL + test.path)
+		resp, _, err := c.get(server.URL + test.path)
 		if test.wantErr {
 			if err == nil {
 				t.Errorf("Test path %q - got nil want error", test.path)
@@ -91,15 +204,18 @@ func TestGet(t *testing.T) {
 			if err != nil {
 				t.Errorf("Test path %q - got error want nil: %v", test.path, err)
 			}
-			if body == nil {
+			if resp == nil || resp.Body == nil {
 				t.Errorf("Test path %q - got nil body", test.path)
+			} else {
+				resp.Body.Close()
 			}
 		}
 	}
 }
 
 func TestVisit(t *testing.T) {
-	wantLinks := map[string]int{"/": 1, "/values": 1}
+	wantLinks := map[string]int{"/": 1, "/values": 1, "/play.png": 1, "/site.css": 1}
+	wantKinds := map[string]string{"/": linkAnchor, "/values": linkAnchor, "/play.png": linkImage, "/site.css": linkStylesheet}
 
 	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
 	defer server.Close()
@@ -115,4 +231,253 @@ func TestVisit(t *testing.T) {
 	if !reflect.DeepEqual(p.links, wantLinks) {
 		t.Errorf("Got links %v, want %v", p.links, wantLinks)
 	}
+	if !reflect.DeepEqual(p.kinds, wantKinds) {
+		t.Errorf("Got link kinds %v, want %v", p.kinds, wantKinds)
+	}
+
+	info, err := os.Stat("testdata/hello-world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.status != http.StatusOK {
+		t.Errorf("Got status %d, want %d", p.status, http.StatusOK)
+	}
+	if p.size != info.Size() {
+		t.Errorf("Got size %d, want %d", p.size, info.Size())
+	}
+	if p.duration <= 0 {
+		t.Errorf("Got duration %v, want > 0", p.duration)
+	}
+	if got := p.header.Get("Content-Type"); got != "text/html; charset=utf-8" {
+		t.Errorf("Got Content-Type %q", got)
+	}
+	if p.header.Get("Last-Modified") == "" {
+		t.Error("Missing Last-Modified header")
+	}
+	if got := p.header.Get("Date"); got != "" {
+		t.Errorf("Got unrecorded Date header %q", got)
+	}
+
+	u, err = url.Parse(server.URL + "/constants")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p = newPage(u)
+	c.visit(p)
+	if !p.broken || p.status != http.StatusNotFound {
+		t.Errorf("Missing page got broken %t and status %d", p.broken, p.status)
+	}
+}
+
+func TestVisitResource(t *testing.T) {
+	methods := map[string][]string{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		methods[r.URL.Path] = append(methods[r.URL.Path], r.Method)
+		if r.URL.Path == "/no-head.png" && r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if r.URL.Path == "/missing.png" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, `<a href="/not-parsed">`)
+	}))
+	defer server.Close()
+
+	c := newCrawler()
+	tests := []struct {
+		path        string
+		wantMethods []string
+		wantBroken  bool
+	}{
+		{path: "/image.png", wantMethods: []string{http.MethodHead}},
+		{path: "/no-head.png", wantMethods: []string{http.MethodHead, http.MethodGet}},
+		{path: "/missing.png", wantMethods: []string{http.MethodHead}, wantBroken: true},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := newPage(u)
+		p.resource = true
+		c.visit(p)
+		if !reflect.DeepEqual(methods[test.path], test.wantMethods) {
+			t.Errorf("Path %q got methods %v, want %v", test.path, methods[test.path], test.wantMethods)
+		}
+		if p.broken != test.wantBroken || !p.resource {
+			t.Errorf("Path %q got broken %t resource %t", test.path, p.broken, p.resource)
+		}
+		if len(p.links) != 0 {
+			t.Errorf("Path %q got links %v from a resource", test.path, p.links)
+		}
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	ctx := context.Background()
+	var none *throttle
+	none.wait(ctx)
+
+	th := &throttle{interval: 20 * time.Millisecond}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		th.wait(ctx)
+	}
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Errorf("Three waits took %v, want at least 40ms", elapsed)
+	}
+
+	// a cancelled wait returns without waiting for its slot
+	th = &throttle{interval: time.Hour}
+	th.wait(ctx)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	start = time.Now()
+	th.wait(cancelled)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Cancelled wait took %v", elapsed)
+	}
+}
+
+// newRedirectServer returns a test server with a set of redirecting paths
+// which end at the testdata pages.
+func newRedirectServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.Dir("testdata")))
+	// The resources linked from the testdata pages, missing from testdata
+	for path, contentType := range map[string]string{"/play.png": "image/png", "/site.css": "text/css"} {
+		contentType := contentType
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+		})
+	}
+	mux.Handle("/old", http.RedirectHandler("/older", http.StatusMovedPermanently))
+	mux.Handle("/older", http.RedirectHandler("/hello-world", http.StatusFound))
+	mux.Handle("/gone", http.RedirectHandler("/constants", http.StatusFound))
+	mux.Handle("/loop1", http.RedirectHandler("/loop2", http.StatusFound))
+	mux.Handle("/loop2", http.RedirectHandler("/loop1", http.StatusFound))
+	mux.Handle("/offsite", http.RedirectHandler("http://example.com/", http.StatusFound))
+	for i := 0; i <= defaultMaxRedirects; i++ {
+		mux.Handle(fmt.Sprintf("/long%d", i), http.RedirectHandler(fmt.Sprintf("/long%d", i+1), http.StatusFound))
+	}
+	return httptest.NewServer(mux)
+}
+
+func TestGetRedirects(t *testing.T) {
+	server := newRedirectServer()
+	defer server.Close()
+
+	tests := []struct {
+		path      string
+		wantHops  []redirect
+		wantErr   bool
+		wantFinal int
+	}{
+		{
+			path: "/old",
+			wantHops: []redirect{
+				{StatusCode: http.StatusMovedPermanently, URL: server.URL + "/old", Location: server.URL + "/older"},
+				{StatusCode: http.StatusFound, URL: server.URL + "/older", Location: server.URL + "/hello-world"},
+			},
+			wantFinal: http.StatusOK,
+		},
+		{
+			path: "/gone",
+			wantHops: []redirect{
+				{StatusCode: http.StatusFound, URL: server.URL + "/gone", Location: server.URL + "/constants"},
+			},
+			wantErr:   true,
+			wantFinal: http.StatusNotFound,
+		},
+		{
+			path: "/loop1",
+			wantHops: []redirect{
+				{StatusCode: http.StatusFound, URL: server.URL + "/loop1", Location: server.URL + "/loop2"},
+				{StatusCode: http.StatusFound, URL: server.URL + "/loop2", Location: server.URL + "/loop1"},
+			},
+			wantErr:   true,
+			wantFinal: http.StatusFound,
+		},
+		{
+			path: "/offsite",
+			wantHops: []redirect{
+				{StatusCode: http.StatusFound, URL: server.URL + "/offsite", Location: "http://example.com/"},
+			},
+			wantErr:   true,
+			wantFinal: http.StatusFound,
+		},
+	}
+
+	c := newCrawler()
+	for _, test := range tests {
+		resp, hops, err := c.get(server.URL + test.path)
+		if (err != nil) != test.wantErr {
+			t.Errorf("Test path %q - got error %v, want error %t", test.path, err, test.wantErr)
+		}
+		if !reflect.DeepEqual(hops, test.wantHops) {
+			t.Errorf("Test path %q - got hops\n%+v\nwant\n%+v", test.path, hops, test.wantHops)
+		}
+		if resp == nil {
+			t.Errorf("Test path %q - got nil response", test.path)
+			continue
+		}
+		if resp.StatusCode != test.wantFinal {
+			t.Errorf("Test path %q - got final status %d, want %d", test.path, resp.StatusCode, test.wantFinal)
+		}
+		if err == nil {
+			resp.Body.Close()
+		}
+	}
+
+	_, hops, err := c.get(server.URL + "/long0")
+	if err == nil {
+		t.Error("Long redirect chain - got nil want error")
+	}
+	if got, want := len(hops), defaultMaxRedirects+1; got != want {
+		t.Errorf("Long redirect chain - got %d hops, want %d", got, want)
+	}
+}
+
+func TestVisitRedirect(t *testing.T) {
+	server := newRedirectServer()
+	defer server.Close()
+
+	tests := []struct {
+		path         string
+		wantBroken   bool
+		wantFindings int
+		wantRedirect string
+	}{
+		{path: "/old", wantRedirect: "/hello-world"},
+		{path: "/gone", wantRedirect: "/constants"},
+		{path: "/loop1", wantBroken: true},
+		{path: "/long0", wantBroken: true},
+		{path: "/offsite", wantFindings: 1},
+	}
+
+	c := newCrawler()
+	for _, test := range tests {
+		u, err := url.Parse(server.URL + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := newPage(u)
+		c.visit(p)
+
+		if p.broken != test.wantBroken {
+			t.Errorf("Test path %q - got broken %t, want %t", test.path, p.broken, test.wantBroken)
+		}
+		if len(p.findings) != test.wantFindings {
+			t.Errorf("Test path %q - got findings %v, want %d", test.path, p.findings, test.wantFindings)
+		}
+		if p.redirect != test.wantRedirect {
+			t.Errorf("Test path %q - got redirect %q, want %q", test.path, p.redirect, test.wantRedirect)
+		}
+		if len(p.links) != 0 {
+			t.Errorf("Test path %q - got links %v from a redirect", test.path, p.links)
+		}
+	}
 }
@@ -0,0 +1,205 @@
+package mapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+)
+
+// The kinds of change between two crawls shown in a diff graph.
+const (
+	changeAdded   = "added"
+	changeRemoved = "removed"
+	changeBroken  = "broken"
+	changeFixed   = "fixed"
+)
+
+// SiteDiff describes the structural changes to a site between two crawls.
+// Each list is sorted by path.
+type SiteDiff struct {
+	Added   []string      `json:"added"`
+	Removed []string      `json:"removed"`
+	Broken  []string      `json:"broken"` // pages broken in the new crawl but not the old
+	Fixed   []string      `json:"fixed"`  // pages broken in the old crawl but not the new
+	Links   []LinkDiff    `json:"links"`
+	Depths  []DepthChange `json:"depths"`
+}
+
+// LinkDiff lists the links added to and removed from a page found in both
+// crawls.
+type LinkDiff struct {
+	Path    string   `json:"path"`
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// DepthChange is a change in the click depth of a page from the starting
+// page. A depth of -1 means the page was not reachable.
+type DepthChange struct {
+	Path string `json:"path"`
+	Old  int    `json:"old"`
+	New  int    `json:"new"`
+}
+
+// Diff compares the old and new crawls of a site.
+func Diff(old, new *SiteMap) *SiteDiff {
+	old.mu.RLock()
+	defer old.mu.RUnlock()
+	new.mu.RLock()
+	defer new.mu.RUnlock()
+	return diff(old, new)
+}
+
+// diff implements Diff, the caller must hold old.mu and new.mu.
+func diff(old, new *SiteMap) *SiteDiff {
+	d := &SiteDiff{
+		Added:   []string{},
+		Removed: []string{},
+		Broken:  []string{},
+		Fixed:   []string{},
+		Links:   []LinkDiff{},
+		Depths:  []DepthChange{},
+	}
+	oldDepths, newDepths := old.depths(), new.depths()
+	for path, p := range new.pages {
+		prev, ok := old.pages[path]
+		if !ok {
+			d.Added = append(d.Added, path)
+			if p.broken {
+				d.Broken = append(d.Broken, path)
+			}
+			continue
+		}
+		switch {
+		case p.broken && !prev.broken:
+			d.Broken = append(d.Broken, path)
+		case !p.broken && prev.broken:
+			d.Fixed = append(d.Fixed, path)
+		}
+
+		ld := LinkDiff{Path: path, Added: []string{}, Removed: []string{}}
+		for link := range p.links {
+			if _, ok := prev.links[link]; !ok {
+				ld.Added = append(ld.Added, link)
+			}
+		}
+		for link := range prev.links {
+			if _, ok := p.links[link]; !ok {
+				ld.Removed = append(ld.Removed, link)
+			}
+		}
+		if len(ld.Added) > 0 || len(ld.Removed) > 0 {
+			sort.Strings(ld.Added)
+			sort.Strings(ld.Removed)
+			d.Links = append(d.Links, ld)
+		}
+
+		dc := DepthChange{Path: path, Old: -1, New: -1}
+		if depth, ok := oldDepths[path]; ok {
+			dc.Old = depth
+		}
+		if depth, ok := newDepths[path]; ok {
+			dc.New = depth
+		}
+		if dc.Old != dc.New {
+			d.Depths = append(d.Depths, dc)
+		}
+	}
+	for path := range old.pages {
+		if _, ok := new.pages[path]; !ok {
+			d.Removed = append(d.Removed, path)
+		}
+	}
+
+	for _, paths := range [][]string{d.Added, d.Removed, d.Broken, d.Fixed} {
+		sort.Strings(paths)
+	}
+	sort.Slice(d.Links, func(i, j int) bool { return d.Links[i].Path < d.Links[j].Path })
+	sort.Slice(d.Depths, func(i, j int) bool { return d.Depths[i].Path < d.Depths[j].Path })
+	return d
+}
+
+// WriteDiffReport writes a human readable report of the changes in d to w.
+func WriteDiffReport(w io.Writer, d *SiteDiff) error {
+	var lines []string
+	for _, section := range []struct {
+		label string
+		paths []string
+	}{
+		{"ADDED", d.Added},
+		{"REMOVED", d.Removed},
+		{"BROKEN", d.Broken},
+		{"FIXED", d.Fixed},
+	} {
+		for _, path := range section.paths {
+			lines = append(lines, fmt.Sprintf("%s %s\n", section.label, path))
+		}
+	}
+	for _, ld := range d.Links {
+		lines = append(lines, fmt.Sprintf("LINKS %s\n", ld.Path))
+		for _, link := range ld.Added {
+			lines = append(lines, fmt.Sprintf("    + %s\n", link))
+		}
+		for _, link := range ld.Removed {
+			lines = append(lines, fmt.Sprintf("    - %s\n", link))
+		}
+	}
+	for _, dc := range d.Depths {
+		lines = append(lines, fmt.Sprintf("DEPTH %s %s -> %s\n", dc.Path, describeDepth(dc.Old), describeDepth(dc.New)))
+	}
+	lines = append(lines, fmt.Sprintf("%d pages added, %d removed, %d broken, %d fixed, %d with changed links and %d with changed depth\n",
+		len(d.Added), len(d.Removed), len(d.Broken), len(d.Fixed), len(d.Links), len(d.Depths)))
+
+	for _, line := range lines {
+		if _, err := io.WriteString(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// describeDepth returns a click depth as a string, unreachable for -1.
+func describeDepth(depth int) string {
+	if depth < 0 {
+		return "unreachable"
+	}
+	return fmt.Sprint(depth)
+}
+
+// DiffHandler returns an http.Handler responding with the differences
+// between the old and new crawls. The format query parameter selects the
+// response, text for a report, graph for a sigma.js graph of both crawls
+// colored by change, otherwise JSON of the SiteDiff.
+func DiffHandler(old, new *SiteMap) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		format := r.URL.Query().Get("format")
+		var buf bytes.Buffer
+		var err error
+		old.mu.RLock()
+		new.mu.RLock()
+		d := diff(old, new)
+		switch format {
+		case "text":
+			err = WriteDiffReport(&buf, d)
+		case "graph":
+			err = json.NewEncoder(&buf).Encode(diffGraph(old, new, d))
+		default:
+			err = json.NewEncoder(&buf).Encode(d)
+		}
+		new.mu.RUnlock()
+		old.mu.RUnlock()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to write site diff: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if format == "text" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		w.Write(buf.Bytes())
+	})
+}
@@ -0,0 +1,147 @@
+package mapper
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+// newDiffSiteMaps returns two site maps of the same site built from the given
+// links between pages, with the listed pages marked broken.
+func newDiffSiteMaps(t *testing.T) (*SiteMap, *SiteMap) {
+	build := func(links map[string]map[string]int, broken ...string) *SiteMap {
+		sm, err := NewSiteMap("http://testsite.com/", 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for path, pageLinks := range links {
+			sm.addPages(map[string]int{path: 1})
+			sm.pages[path].links = pageLinks
+			sm.addPages(pageLinks)
+		}
+		for _, path := range broken {
+			sm.pages[path].broken = true
+		}
+		return sm
+	}
+	old := build(map[string]map[string]int{
+		"/":  {"/a": 1, "/b": 1},
+		"/a": {"/c": 1},
+		"/b": {},
+		"/c": {},
+	}, "/c")
+	new := build(map[string]map[string]int{
+		"/":  {"/a": 1, "/c": 1, "/d": 1},
+		"/a": {"/": 1},
+		"/c": {},
+		"/d": {},
+	}, "/d")
+	return old, new
+}
+
+func TestDiff(t *testing.T) {
+	old, new := newDiffSiteMaps(t)
+	want := &SiteDiff{
+		Added:   []string{"/d"},
+		Removed: []string{"/b"},
+		Broken:  []string{"/d"},
+		Fixed:   []string{"/c"},
+		Links: []LinkDiff{
+			{Path: "/", Added: []string{"/c", "/d"}, Removed: []string{"/b"}},
+			{Path: "/a", Added: []string{"/"}, Removed: []string{"/c"}},
+		},
+		Depths: []DepthChange{{Path: "/c", Old: 2, New: 1}},
+	}
+	got := Diff(old, new)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("Got diff\n%+v\nwant\n%+v", got, want)
+	}
+
+	var report bytes.Buffer
+	if err := WriteDiffReport(&report, got); err != nil {
+		t.Fatal(err)
+	}
+	wantReport := "ADDED /d\n" +
+		"REMOVED /b\n" +
+		"BROKEN /d\n" +
+		"FIXED /c\n" +
+		"LINKS /\n" +
+		"    + /c\n" +
+		"    + /d\n" +
+		"    - /b\n" +
+		"LINKS /a\n" +
+		"    + /\n" +
+		"    - /c\n" +
+		"DEPTH /c 2 -> 1\n" +
+		"1 pages added, 1 removed, 1 broken, 1 fixed, 2 with changed links and 1 with changed depth\n"
+	if report.String() != wantReport {
+		t.Errorf("Got report\n%s\nwant\n%s", report.String(), wantReport)
+	}
+}
+
+func TestDiffHandler(t *testing.T) {
+	old, new := newDiffSiteMaps(t)
+	h := DiffHandler(old, new)
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/diff", nil))
+	var d SiteDiff
+	if err := json.Unmarshal(w.Body.Bytes(), &d); err != nil {
+		t.Fatalf("Failed to decode diff JSON: %v", err)
+	}
+	if want := []string{"/d"}; !reflect.DeepEqual(d.Added, want) {
+		t.Errorf("Got added %v, want %v", d.Added, want)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/diff?format=graph", nil))
+	var graph smJSON
+	if err := json.Unmarshal(w.Body.Bytes(), &graph); err != nil {
+		t.Fatalf("Failed to decode diff graph: %v", err)
+	}
+	nodes := map[string]nodeJSON{}
+	for _, n := range graph.Nodes {
+		nodes[n.ID] = n
+	}
+	for id, want := range map[string]nodeJSON{
+		"/":  {Label: "/"},
+		"/a": {Label: "/a"},
+		"/b": {Label: "/b", Change: changeRemoved, Color: removedColor},
+		"/c": {Label: "/c (depth 2 -> 1)", Change: changeFixed, Color: fixedColor},
+		"/d": {Label: "/d", Change: changeAdded, Color: failColor},
+	} {
+		n := nodes[id]
+		if n.Label != want.Label || n.Change != want.Change || n.Color != want.Color {
+			t.Errorf("Node %s got label %q change %q color %q, want %q %q %q",
+				id, n.Label, n.Change, n.Color, want.Label, want.Change, want.Color)
+		}
+	}
+	if len(graph.Nodes) != 5 {
+		t.Errorf("Got %d nodes, want 5", len(graph.Nodes))
+	}
+
+	edges := map[string]string{}
+	for _, e := range graph.Edges {
+		edges[e.ID] = e.Change
+	}
+	wantEdges := map[string]string{
+		"/->/a":  "",
+		"/->/b":  changeRemoved,
+		"/->/c":  changeAdded,
+		"/->/d":  changeAdded,
+		"/a->/":  changeAdded,
+		"/a->/c": changeRemoved,
+	}
+	if !reflect.DeepEqual(edges, wantEdges) {
+		t.Errorf("Got edges %v, want %v", edges, wantEdges)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/diff?format=text", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+		t.Errorf("Got text Content-Type %q", ct)
+	}
+}
@@ -0,0 +1,195 @@
+package mapper
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultExternalWorkers  = 2
+	defaultExternalInterval = time.Second
+)
+
+// externalLink is a link from the crawled sites to a URL on another site
+// along with the result of checking it.
+type externalLink struct {
+	checked  bool
+	duration time.Duration
+	err      error
+	status   int // the HTTP status code at the end of any redirects, 0 if no response was received
+	url      string
+}
+
+// broken reports if checking l failed.
+func (l *externalLink) broken() bool {
+	return l.checked && (l.err != nil || l.status < 200 || l.status > 299)
+}
+
+// externalLink returns the URL of link, without any fragment, if it is an
+// http or https link to a host other than those of sites. A nil sites is
+// only the host of p.
+func (p *page) externalLink(link string, n *Normalizer, sites *siteHosts) (string, bool) {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", false
+	}
+	if sites == nil {
+		sites = &siteHosts{hosts: []string{n.host(p.url)}}
+	}
+	if _, ok := sites.key(u, n); ok {
+		return "", false
+	}
+	u.Fragment = ""
+	return u.String(), true
+}
+
+// checkExternal starts workers go routines which check the links from the
+// links channel, putting the result onto the checked channel. Like crawl
+// they are halted by cancelling c.ctx.
+func (c *crawler) checkExternal(links <-chan *externalLink, checked chan<- *externalLink, workers int) {
+	ctx := c.context()
+	for i := 0; i < workers; i++ {
+		c.workers.Add(1)
+		go func() {
+			defer c.workers.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case l := <-links:
+					if u, err := url.Parse(l.url); err == nil {
+						c.externalThrottle.wait(ctx, u.Host)
+					}
+					c.check(l)
+					select {
+					case checked <- l:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}
+		}()
+	}
+}
+
+// check requests the external link l with a HEAD request, falling back to
+// GET if the server does not allow HEAD, following any redirects. The
+// status of the final response is recorded on l.
+func (c *crawler) check(l *externalLink) {
+	start := time.Now()
+	resp, err := c.request(http.MethodHead, l.url)
+	if err == nil && (resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented) {
+		resp.Body.Close()
+		resp, err = c.request(http.MethodGet, l.url)
+	}
+	l.checked = true
+	l.duration = time.Since(start)
+	externalChecks.Inc()
+	if err != nil {
+		l.err = err
+		return
+	}
+	resp.Body.Close()
+	l.status = resp.StatusCode
+	if l.broken() {
+		l.err = fmt.Errorf("Status code %d", resp.StatusCode)
+	}
+}
+
+// request issues a single request for the URL with the crawler's user-agent,
+// but never its credentials, using c.externalClient which follows redirects.
+func (c *crawler) request(method, rawURL string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(c.context(), method, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if c.userAgent != "" {
+		req.Header.Set("User-Agent", c.userAgent)
+	}
+	return c.externalClient.Do(req)
+}
+
+// hostThrottle enforces a minimum interval between requests to each host.
+// A nil hostThrottle never waits.
+type hostThrottle struct {
+	interval time.Duration
+	mu       sync.Mutex
+	hosts    map[string]*throttle
+}
+
+// wait blocks until the next request slot for host is available or ctx is
+// done.
+func (h *hostThrottle) wait(ctx context.Context, host string) {
+	if h == nil || h.interval <= 0 {
+		return
+	}
+	h.mu.Lock()
+	if h.hosts == nil {
+		h.hosts = map[string]*throttle{}
+	}
+	t, ok := h.hosts[host]
+	if !ok {
+		t = &throttle{interval: h.interval}
+		h.hosts[host] = t
+	}
+	h.mu.Unlock()
+	t.wait(ctx)
+}
+
+// BrokenExternalLinks returns the external links found broken when
+// CheckExternal is set, sorted by URL. The Path of each is its URL.
+func (sm *SiteMap) BrokenExternalLinks() []BrokenPage {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	broken := map[string]*BrokenPage{}
+	for u, l := range sm.external {
+		if !l.broken() {
+			continue
+		}
+		bp := &BrokenPage{Path: u, URL: u, Status: l.status}
+		if l.err != nil {
+			bp.Error = l.err.Error()
+		}
+		broken[u] = bp
+	}
+	for path, p := range sm.pages {
+		for u := range p.external {
+			if bp, ok := broken[u]; ok {
+				bp.LinkedFrom = append(bp.LinkedFrom, path)
+			}
+		}
+	}
+
+	links := make([]BrokenPage, 0, len(broken))
+	for _, bp := range broken {
+		sort.Strings(bp.LinkedFrom)
+		links = append(links, *bp)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Path < links[j].Path })
+	return links
+}
+
+// uncheckedExternal returns the external links from p not yet checked,
+// adding those new to sm.external. Links in queued are skipped as they are
+// already being checked. The caller must hold sm.mu.
+func (sm *SiteMap) uncheckedExternal(p *page, queued map[string]bool) []*externalLink {
+	var links []*externalLink
+	for u := range p.external {
+		l, ok := sm.external[u]
+		if !ok {
+			l = &externalLink{url: u}
+			sm.external[u] = l
+		}
+		if l.checked || queued[u] {
+			continue
+		}
+		queued[u] = true
+		links = append(links, &externalLink{url: u})
+	}
+	return links
+}
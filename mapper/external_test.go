@@ -0,0 +1,151 @@
+package mapper
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+)
+
+func TestPageExternalLink(t *testing.T) {
+	u, err := url.Parse("http://example.com/a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newPage(u)
+	tests := []struct {
+		link string
+		want string
+		ok   bool
+	}{
+		{"/b", "", false},
+		{"http://example.com/b", "", false},
+		{"https://example.com/b", "", false},
+		{"mailto:someone@example.com", "", false},
+		{"http://other.com/b#top", "http://other.com/b", true},
+		{"https://other.com/b?q=1", "https://other.com/b?q=1", true},
+	}
+	for _, test := range tests {
+		got, ok := p.externalLink(test.link, &Normalizer{}, nil)
+		if got != test.want || ok != test.ok {
+			t.Errorf("Link %q got %q, %v want %q, %v", test.link, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestStartCheckExternal(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.Method+" "+r.URL.Path]++
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/ok":
+		case "/nohead":
+			if r.Method == http.MethodHead {
+				w.WriteHeader(http.StatusMethodNotAllowed)
+			}
+		case "/redirect":
+			http.Redirect(w, r, "/ok", http.StatusFound)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer external.Close()
+
+	site := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprintf(w, `<a href="/other">other</a><a href="%[1]s/ok">ok</a><a href="%[1]s/missing">missing</a>`, external.URL)
+		case "/other":
+			fmt.Fprintf(w, `<a href="%[1]s/ok#top">ok</a><a href="%[1]s/nohead">nohead</a><a href="%[1]s/redirect">redirect</a>`, external.URL)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer site.Close()
+
+	sm, err := NewSiteMap(site.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.CheckExternal = true
+	sm.ExternalInterval = 0
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+
+	if got, want := len(sm.pages), 2; got != want {
+		t.Errorf("Got %d pages, want %d, external links must not be crawled", got, want)
+	}
+	wantStatus := map[string]int{
+		external.URL + "/ok":       http.StatusOK,
+		external.URL + "/missing":  http.StatusNotFound,
+		external.URL + "/nohead":   http.StatusOK,
+		external.URL + "/redirect": http.StatusOK,
+	}
+	if got, want := len(sm.external), len(wantStatus); got != want {
+		t.Errorf("Got %d external links, want %d", got, want)
+	}
+	for u, want := range wantStatus {
+		l, ok := sm.external[u]
+		if !ok {
+			t.Errorf("External link %q not found", u)
+			continue
+		}
+		if !l.checked {
+			t.Errorf("External link %q not checked", u)
+		}
+		if l.status != want {
+			t.Errorf("External link %q got status %d, want %d", u, l.status, want)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := requests["HEAD /ok"], 2; got != want {
+		t.Errorf("Got %d HEAD requests for /ok, want %d, once linked and once redirected to", got, want)
+	}
+	if got, want := requests["GET /nohead"], 1; got != want {
+		t.Errorf("Got %d GET requests for /nohead, want %d", got, want)
+	}
+
+	broken := sm.BrokenExternalLinks()
+	if len(broken) != 1 {
+		t.Fatalf("Got %d broken external links, want 1", len(broken))
+	}
+	if got, want := broken[0].URL, external.URL+"/missing"; got != want {
+		t.Errorf("Got broken external link %q, want %q", got, want)
+	}
+	if got := broken[0].LinkedFrom; len(got) != 1 || got[0] != "/" {
+		t.Errorf("Got broken external link linked from %v, want [/]", got)
+	}
+
+	// the results are saved and a resumed crawl checks nothing again
+	var buf bytes.Buffer
+	if err := sm.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSiteMap(&buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded.CheckExternal = true
+	requests = map[string]int{}
+	mu.Unlock()
+	err = loaded.Start(context.Background())
+	mu.Lock()
+	if err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if len(requests) != 0 {
+		t.Errorf("Got requests %v for links already checked", requests)
+	}
+	if got, want := len(loaded.BrokenExternalLinks()), 1; got != want {
+		t.Errorf("Got %d broken external links after loading, want %d", got, want)
+	}
+}
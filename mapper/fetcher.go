@@ -0,0 +1,96 @@
+package mapper
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+)
+
+// Fetcher retrieves the response to a request in place of sending it over the
+// network, letting a site be crawled from another source such as a directory
+// or an archive. Responses are handled as those received over HTTP, so
+// redirects are followed and any status other than 2XX is broken. An error
+// is returned if there is no response for the request at all.
+type Fetcher interface {
+	Fetch(req *http.Request) (*http.Response, error)
+}
+
+// fetcherTransport is an http.RoundTripper getting its responses from a
+// Fetcher.
+type fetcherTransport struct {
+	Fetcher
+}
+
+func (t fetcherTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.Fetch(req)
+}
+
+// DirFetcher is a Fetcher serving the files in the Root directory, such as
+// the output of a static site generator, as net/http's FileServer does. The
+// index.html file of a directory is served for the directory and requests for
+// a directory without a trailing slash are redirected to add it. If Host is
+// set requests to any other host fail, otherwise the files are served for all
+// hosts.
+type DirFetcher struct {
+	Root string
+	Host string
+}
+
+// Fetch implements the Fetcher interface.
+func (f DirFetcher) Fetch(req *http.Request) (*http.Response, error) {
+	if f.Host != "" && req.URL.Host != f.Host {
+		return nil, fmt.Errorf("%s is not served from the directory %s", req.URL, f.Root)
+	}
+	rec := newResponseRecorder()
+	http.FileServer(http.Dir(f.Root)).ServeHTTP(rec, req)
+	return rec.response(req), nil
+}
+
+// responseRecorder is an http.ResponseWriter keeping the response in memory.
+type responseRecorder struct {
+	body   bytes.Buffer
+	header http.Header
+	status int
+}
+
+func newResponseRecorder() *responseRecorder {
+	return &responseRecorder{header: http.Header{}}
+}
+
+func (r *responseRecorder) Header() http.Header {
+	return r.header
+}
+
+func (r *responseRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	return r.body.Write(b)
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+// response returns the recorded response to req.
+func (r *responseRecorder) response(req *http.Request) *http.Response {
+	status := r.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &http.Response{
+		Status:        strconv.Itoa(status) + " " + http.StatusText(status),
+		StatusCode:    status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        r.header,
+		Body:          ioutil.NopCloser(bytes.NewReader(r.body.Bytes())),
+		ContentLength: int64(r.body.Len()),
+		Request:       req,
+	}
+}
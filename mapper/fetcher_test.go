@@ -0,0 +1,119 @@
+package mapper
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirFetcher(t *testing.T) {
+	f := DirFetcher{Root: "testdata", Host: "site.test"}
+	tests := []struct {
+		url    string
+		status int
+		err    bool
+	}{
+		{"http://site.test/hello-world", http.StatusOK, false},
+		{"http://site.test/missing", http.StatusNotFound, false},
+		{"http://site.test/index.html", http.StatusMovedPermanently, false},
+		{"http://other.test/hello-world", 0, true},
+	}
+	for _, test := range tests {
+		req, err := http.NewRequest(http.MethodGet, test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := f.Fetch(req)
+		if (err != nil) != test.err {
+			t.Errorf("URL %s got error %v, want error %v", test.url, err, test.err)
+		}
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode != test.status {
+			t.Errorf("URL %s got status %d, want %d", test.url, resp.StatusCode, test.status)
+		}
+	}
+}
+
+func TestStartDirFetcher(t *testing.T) {
+	sm, err := NewSiteMap("http://site.test/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Fetcher = DirFetcher{Root: "testdata", Host: "site.test"}
+	sm.Retries = 0
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+
+	wantBroken := map[string]bool{
+		"/":            false,
+		"/hello-world": false,
+		"/values":      false,
+		"/variables":   false,
+		"/constants":   true,
+		"/play.png":    true,
+		"/site.css":    true,
+	}
+	if got, want := len(sm.pages), len(wantBroken); got != want {
+		t.Errorf("Got %d pages, want %d", got, want)
+	}
+	for path, p := range sm.pages {
+		broken, ok := wantBroken[path]
+		if !ok {
+			t.Errorf("Got unwanted path %q", path)
+			continue
+		}
+		if !p.visited || p.broken != broken {
+			t.Errorf("Path %q got visited %v broken %v, want visited broken %v", path, p.visited, p.broken, broken)
+		}
+	}
+}
+
+func TestStartFetcherCheckExternal(t *testing.T) {
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ok" {
+			http.NotFound(w, r)
+		}
+	}))
+	defer external.Close()
+
+	dir, err := ioutil.TempDir("", "site")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	index := fmt.Sprintf(`<a href="%[1]s/ok">ok</a><a href="%[1]s/missing">missing</a>`, external.URL)
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(index), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sm, err := NewSiteMap("http://site.test/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Fetcher = DirFetcher{Root: dir, Host: "site.test"}
+	sm.CheckExternal = true
+	sm.ExternalInterval = 0
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+
+	for u, want := range map[string]int{external.URL + "/ok": http.StatusOK, external.URL + "/missing": http.StatusNotFound} {
+		l, ok := sm.external[u]
+		if !ok {
+			t.Errorf("External link %q not found", u)
+			continue
+		}
+		if l.status != want {
+			t.Errorf("External link %q got status %d (%v), want %d checked over the network", u, l.status, l.err, want)
+		}
+	}
+}
@@ -3,50 +3,332 @@ package mapper
 import (
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"hash/fnv"
 	"net/http"
 )
 
-const failColor = "#ec5148"
+const (
+	failColor      = "#ec5148"
+	redirectColor  = "#f5a623"
+	skippedColor   = "#aaaaaa"
+	addedColor     = "#4caf50"
+	removedColor   = "#8c564b"
+	fixedColor     = "#17becf"
+	resourceColor  = "#c5b0d5"
+	canonicalColor = "#bcbd22"
+	externalColor  = "#9edae5"
+)
+
+// siteColors are the colors of the nodes of each site when more than one is
+// crawled, chosen to be distinct from the colors marking pages.
+var siteColors = []string{"#1f77b4", "#2ca02c", "#9467bd", "#e377c2", "#7f7f7f", "#ff7f0e", "#aec7e8", "#98df8a"}
+
+// siteSpacing separates the clusters of nodes of each site, nodePosition
+// places nodes within 1000 of the origin.
+const siteSpacing = 1200
+
+// The kinds of edges in the site map graph, link edges use the kind of the
+// link, edgeLink being an anchor.
+const (
+	edgeLink     = linkAnchor
+	edgeRedirect = "redirect"
+	edgeExternal = "external"
+)
 
 type nodeJSON struct {
-	Color string `json:"color"`
-	ID    string `json:"id"`
-	Label string `json:"label"`
-	Size  int    `json:"size"`
-	X     int    `json:"x"`
-	Y     int    `json:"y"`
+	Bytes        int64             `json:"bytes,omitempty"`
+	Canonical    string            `json:"canonical,omitempty"`
+	Change       string            `json:"change,omitempty"`
+	Color        string            `json:"color"`
+	Error        string            `json:"error,omitempty"`
+	ErrorClass   string            `json:"errorClass,omitempty"`
+	External     bool              `json:"external,omitempty"` // a checked link to another site, its id is the URL
+	FetchSeconds float64           `json:"fetchSeconds,omitempty"`
+	Findings     []string          `json:"findings,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	ID           string            `json:"id"`
+	Label        string            `json:"label"`
+	Redirects    []redirect        `json:"redirects,omitempty"`
+	Resource     bool              `json:"resource,omitempty"`
+	Retries      int               `json:"retries,omitempty"`
+	Site         string            `json:"site,omitempty"` // the host of the page's site when crawling several
+	Size         int               `json:"size"`
+	Skipped      string            `json:"skipped,omitempty"`
+	Status       int               `json:"status,omitempty"`
+	X            int               `json:"x"`
+	Y            int               `json:"y"`
 }
 
 type edgeJSON struct {
+	Change string `json:"change,omitempty"`
+	Color  string `json:"color,omitempty"`
 	ID     string `json:"id"`
+	Kind   string `json:"kind"`
 	Source string `json:"source"`
 	Target string `json:"target"`
 }
 
 type smJSON struct {
-	Nodes []nodeJSON `json:"nodes"`
-	Edges []edgeJSON `json:"edges"`
+	Nodes     []nodeJSON      `json:"nodes"`
+	Edges     []edgeJSON      `json:"edges"`
+	Recrawl   *RecrawlSummary `json:"recrawl,omitempty"`
+	State     string          `json:"state"`
+	Sites     []siteJSON      `json:"sites,omitempty"`
+	Truncated string          `json:"truncated,omitempty"` // the limit which cut the crawl short
+}
+
+// siteJSON summarizes one of several sites crawled together along with the
+// color of its nodes.
+type siteJSON struct {
+	SiteSummary
+	Color string `json:"color"`
 }
 
 // MarshalJSON outputs the JSON representaion of sm needed for use by sigmajs
 // to display a site map. It implements the json.Marshaller interface.
 func (sm *SiteMap) MarshalJSON() ([]byte, error) {
-	j := smJSON{Nodes: []nodeJSON{}, Edges: []edgeJSON{}}
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	j := smJSON{Nodes: []nodeJSON{}, Edges: []edgeJSON{}, State: sm.state, Truncated: sm.truncated}
+	if sm.Baseline != nil && sm.state == stateFinished {
+		j.Recrawl = sm.recrawlSummary()
+	}
 
+	// with several sites the nodes of each are clustered and colored by site
+	var sites map[string]int // the index of each site by siteHost
+	if len(sm.others) > 0 {
+		sites = map[string]int{}
+		for i, key := range sm.startKeys() {
+			sites[siteHost(key)] = i
+		}
+		for i, summary := range sm.siteSummaries() {
+			j.Sites = append(j.Sites, siteJSON{SiteSummary: summary, Color: siteColors[i%len(siteColors)]})
+		}
+	}
+
+	hosts := sm.hosts()
 	for id, p := range sm.pages {
-		n := nodeJSON{ID: id, Label: id, X: rand.Intn(1000), Y: rand.Intn(1000)}
-		if p.broken {
-			n.Color = failColor
+		n := pageNode(id, p, p.nonCanonical(&sm.Normalization, hosts))
+		if sites != nil {
+			i := sites[siteHost(id)]
+			n.Site = j.Sites[i].Host
+			if n.Color == "" {
+				n.Color = j.Sites[i].Color
+			}
+			n.X += (i % 4) * siteSpacing
+			n.Y += (i / 4) * siteSpacing
 		}
 		j.Nodes = append(j.Nodes, n)
-		for path := range p.links {
-			j.Edges = append(j.Edges, edgeJSON{ID: fmt.Sprintf("%s->%s", id, path), Source: id, Target: path})
-		}
+		j.Edges = append(j.Edges, pageEdges(id, p)...)
+		j.Edges = append(j.Edges, externalEdges(id, p, sm.external)...)
+	}
+	for _, l := range sm.external {
+		j.Nodes = append(j.Nodes, externalNode(l))
 	}
 	return json.Marshal(j)
 }
 
+// externalNode returns the graph node for the link to another site l, a leaf
+// with the URL as its id.
+func externalNode(l *externalLink) nodeJSON {
+	x, y := nodePosition(l.url)
+	n := nodeJSON{
+		Color:        externalColor,
+		External:     true,
+		FetchSeconds: l.duration.Seconds(),
+		ID:           l.url,
+		Label:        l.url,
+		Status:       l.status,
+		X:            x,
+		Y:            y,
+	}
+	if !l.checked {
+		n.Label = fmt.Sprintf("%s (unchecked)", l.url)
+	}
+	if l.broken() {
+		n.Color = failColor
+	}
+	if l.err != nil {
+		n.Error = l.err.Error()
+	}
+	return n
+}
+
+// externalEdges returns the graph edges for the links from the page p with
+// the given id to other sites, skipping those without a node in external.
+func externalEdges(id string, p *page, external map[string]*externalLink) []edgeJSON {
+	edges := make([]edgeJSON, 0, len(p.external))
+	for u := range p.external {
+		if _, ok := external[u]; !ok {
+			continue
+		}
+		edges = append(edges, edgeJSON{
+			Color:  externalColor,
+			ID:     fmt.Sprintf("%s->%s", id, u),
+			Kind:   edgeExternal,
+			Source: id,
+			Target: u,
+		})
+	}
+	return edges
+}
+
+// pageNode returns the graph node for the page p with the given id, colored
+// as non-canonical if nonCanonical is set.
+func pageNode(id string, p *page, nonCanonical bool) nodeJSON {
+	x, y := nodePosition(id)
+	n := nodeJSON{
+		Bytes:        p.size,
+		Canonical:    p.canonical,
+		ErrorClass:   p.errClass,
+		FetchSeconds: p.duration.Seconds(),
+		Findings:     p.findings,
+		ID:           id,
+		Label:        id,
+		Redirects:    p.redirects,
+		Resource:     p.resource,
+		Retries:      p.retries,
+		Skipped:      p.skipped,
+		Status:       p.status,
+		X:            x,
+		Y:            y,
+	}
+	if p.err != nil {
+		n.Error = p.err.Error()
+	}
+	if len(p.header) > 0 {
+		n.Headers = map[string]string{}
+		for key := range p.header {
+			n.Headers[key] = p.header.Get(key)
+		}
+	}
+	switch {
+	case p.broken:
+		n.Color = failColor
+	case p.skipped != "":
+		n.Color = skippedColor
+		n.Label = fmt.Sprintf("%s (%s)", id, p.skipped)
+	case p.resource:
+		n.Color = resourceColor
+	case nonCanonical:
+		n.Color = canonicalColor
+	}
+	return n
+}
+
+// pageEdges returns the graph edges for the links and redirect of the page p
+// with the given id. Edges to resources are colored to set them apart from
+// navigation.
+func pageEdges(id string, p *page) []edgeJSON {
+	edges := make([]edgeJSON, 0, len(p.links)+1)
+	for path := range p.links {
+		e := edgeJSON{ID: fmt.Sprintf("%s->%s", id, path), Kind: p.linkKind(path), Source: id, Target: path}
+		if isResource(e.Kind) {
+			e.Color = resourceColor
+		}
+		edges = append(edges, e)
+	}
+	if p.redirect != "" {
+		edges = append(edges, edgeJSON{
+			Color:  redirectColor,
+			ID:     fmt.Sprintf("%s=>%s", id, p.redirect),
+			Kind:   edgeRedirect,
+			Source: id,
+			Target: p.redirect,
+		})
+	}
+	return edges
+}
+
+// diffGraph returns a graph merging the pages of the old and new site maps
+// with the nodes and edges colored by how they changed as described by d.
+// The caller must hold old.mu and new.mu.
+func diffGraph(old, new *SiteMap, d *SiteDiff) smJSON {
+	changes := map[string]string{}
+	for _, c := range []struct {
+		change string
+		paths  []string
+	}{
+		{changeBroken, d.Broken},
+		{changeFixed, d.Fixed},
+		{changeAdded, d.Added},
+		{changeRemoved, d.Removed},
+	} {
+		for _, path := range c.paths {
+			changes[path] = c.change
+		}
+	}
+	depths := map[string]DepthChange{}
+	for _, dc := range d.Depths {
+		depths[dc.Path] = dc
+	}
+
+	j := smJSON{Nodes: []nodeJSON{}, Edges: []edgeJSON{}, State: new.state}
+	newHosts, oldHosts := new.hosts(), old.hosts()
+	for id, p := range new.pages {
+		n := pageNode(id, p, p.nonCanonical(&new.Normalization, newHosts))
+		n.Change = changes[id]
+		switch {
+		case p.broken:
+			// broken pages keep the failColor whatever their change
+		case n.Change == changeAdded:
+			n.Color = addedColor
+		case n.Change == changeFixed:
+			n.Color = fixedColor
+		}
+		if dc, ok := depths[id]; ok {
+			n.Label = fmt.Sprintf("%s (depth %s -> %s)", n.Label, describeDepth(dc.Old), describeDepth(dc.New))
+		}
+		j.Nodes = append(j.Nodes, n)
+		for _, e := range pageEdges(id, p) {
+			if !old.hasEdge(e) {
+				e.Change = changeAdded
+				e.Color = addedColor
+			}
+			j.Edges = append(j.Edges, e)
+		}
+	}
+	for id, p := range old.pages {
+		if _, ok := new.pages[id]; !ok {
+			n := pageNode(id, p, p.nonCanonical(&old.Normalization, oldHosts))
+			n.Change = changeRemoved
+			n.Color = removedColor
+			j.Nodes = append(j.Nodes, n)
+		}
+		for _, e := range pageEdges(id, p) {
+			if !new.hasEdge(e) {
+				e.Change = changeRemoved
+				e.Color = removedColor
+				j.Edges = append(j.Edges, e)
+			}
+		}
+	}
+	return j
+}
+
+// hasEdge reports if the graph edge e exists in sm. The caller must hold
+// sm.mu.
+func (sm *SiteMap) hasEdge(e edgeJSON) bool {
+	p, ok := sm.pages[e.Source]
+	if !ok {
+		return false
+	}
+	if e.Kind == edgeRedirect {
+		return p.redirect == e.Target
+	}
+	_, ok = p.links[e.Target]
+	return ok
+}
+
+// nodePosition returns an x, y position for a node derived from its id so
+// that a node keeps the same place each time the JSON is requested.
+func nodePosition(id string) (int, int) {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	sum := int(h.Sum32())
+	return sum % 1000, (sum / 1000) % 1000
+}
+
 // ServeHTTP implments the http.Handler interface responding with sm marshaled
 // as JSON.
 func (sm *SiteMap) ServeHTTP(w http.ResponseWriter, r *http.Request) {
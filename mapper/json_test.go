@@ -1,6 +1,7 @@
 package mapper
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
@@ -20,21 +21,29 @@ func TestJSON(t *testing.T) {
 			nodeJSON{ID: "/values", Label: "/values"},
 			nodeJSON{ID: "/variables", Label: "/variables"},
 			nodeJSON{ID: "/constants", Label: "/constants", Color: failColor},
+			nodeJSON{ID: "/play.png", Label: "/play.png", Color: resourceColor},
+			nodeJSON{ID: "/site.css", Label: "/site.css", Color: resourceColor},
 		},
 		Edges: []edgeJSON{
-			edgeJSON{ID: "/->/hello-world", Source: "/", Target: "/hello-world"},
-			edgeJSON{ID: "/->/values", Source: "/", Target: "/values"},
-			edgeJSON{ID: "/->/variables", Source: "/", Target: "/variables"},
-			edgeJSON{ID: "/hello-world->/", Source: "/hello-world", Target: "/"},
-			edgeJSON{ID: "/hello-world->/values", Source: "/hello-world", Target: "/values"},
-			edgeJSON{ID: "/values->/", Source: "/values", Target: "/"},
-			edgeJSON{ID: "/values->/variables", Source: "/values", Target: "/variables"},
-			edgeJSON{ID: "/variables->/", Source: "/variables", Target: "/"},
-			edgeJSON{ID: "/variables->/constants", Source: "/variables", Target: "/constants"},
+			edgeJSON{ID: "/->/hello-world", Kind: edgeLink, Source: "/", Target: "/hello-world"},
+			edgeJSON{ID: "/->/values", Kind: edgeLink, Source: "/", Target: "/values"},
+			edgeJSON{ID: "/->/variables", Kind: edgeLink, Source: "/", Target: "/variables"},
+			edgeJSON{ID: "/hello-world->/", Kind: edgeLink, Source: "/hello-world", Target: "/"},
+			edgeJSON{ID: "/hello-world->/values", Kind: edgeLink, Source: "/hello-world", Target: "/values"},
+			edgeJSON{ID: "/values->/", Kind: edgeLink, Source: "/values", Target: "/"},
+			edgeJSON{ID: "/values->/variables", Kind: edgeLink, Source: "/values", Target: "/variables"},
+			edgeJSON{ID: "/variables->/", Kind: edgeLink, Source: "/variables", Target: "/"},
+			edgeJSON{ID: "/variables->/constants", Kind: edgeLink, Source: "/variables", Target: "/constants"},
 		},
 	}
+	for _, source := range []string{"/hello-world", "/values", "/variables"} {
+		wantSM.Edges = append(wantSM.Edges,
+			edgeJSON{ID: source + "->/play.png", Color: resourceColor, Kind: linkImage, Source: source, Target: "/play.png"},
+			edgeJSON{ID: source + "->/site.css", Color: resourceColor, Kind: linkStylesheet, Source: source, Target: "/site.css"},
+		)
+	}
 
-	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	server := newRedirectServer()
 	defer server.Close()
 
 	u, err := url.Parse(server.URL + "/hello-world")
@@ -47,7 +56,7 @@ func TestJSON(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := sm.Start(); err != nil {
+	if err := sm.Start(context.Background()); err != nil {
 		t.Errorf("Start error: %v", err)
 	}
 
@@ -81,9 +90,63 @@ func TestJSON(t *testing.T) {
 	sort.Slice(wantSM.Nodes, func(i, j int) bool { return wantSM.Nodes[i].ID < wantSM.Nodes[j].ID })
 	for i, got := range gotSM.Nodes {
 		want := wantSM.Nodes[i]
-		// note this does not validate x/y positions as they are randomized
+		// note this does not validate x/y positions as they are arbitrary
 		if got.ID != want.ID || got.Label != want.Label || got.Color != want.Color {
 			t.Errorf("Node %d - got %#v, want %#v", i, got, want)
 		}
+		if got.Color == failColor && got.Status != http.StatusNotFound {
+			t.Errorf("Node %q - got status %d for a broken page", got.ID, got.Status)
+		}
+		if got.Color != failColor && (got.Status != http.StatusOK || got.Headers["Content-Type"] == "") {
+			t.Errorf("Node %q - got status %d and headers %v", got.ID, got.Status, got.Headers)
+		}
+	}
+}
+
+func TestJSONWhileCrawling(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error)
+	go func() { done <- sm.Start(context.Background()) }()
+
+	for finished := false; !finished; {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("Start error: %v", err)
+			}
+			finished = true
+		default:
+		}
+		j, err := sm.MarshalJSON()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got smJSON
+		if err := json.Unmarshal(j, &got); err != nil {
+			t.Fatal(err)
+		}
+		nodes := map[string]bool{}
+		for _, n := range got.Nodes {
+			nodes[n.ID] = true
+		}
+		for _, e := range got.Edges {
+			if !nodes[e.Source] || !nodes[e.Target] {
+				t.Errorf("Got edge %s without a node for both ends", e.ID)
+			}
+		}
+		if finished && got.State != stateFinished {
+			t.Errorf("Got state %q after Start returned, want %q", got.State, stateFinished)
+		}
+		sm.BrokenPages()
+		if _, err := sm.XMLSitemaps(XMLSitemapOptions{}); err != nil {
+			t.Fatal(err)
+		}
 	}
 }
@@ -0,0 +1,41 @@
+package mapper
+
+import "fmt"
+
+// The skipped reasons for pages beyond the limits of the crawl.
+const (
+	skipDepth = "beyond max depth"
+	skipPages = "beyond max pages"
+)
+
+// Truncated returns the reason the last crawl was cut short by one of its
+// limits, an empty string if it was not.
+func (sm *SiteMap) Truncated() string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.truncated
+}
+
+// limitReason returns the skipped reason if visiting p would exceed
+// sm.MaxDepth or sm.MaxPages given the number of pages already queued,
+// recording the crawl as truncated. An empty string is returned if p is
+// within the limits. The caller must hold sm.mu.
+func (sm *SiteMap) limitReason(p *page, queued int) string {
+	switch {
+	case sm.MaxDepth > 0 && p.depth > sm.MaxDepth:
+		sm.truncate(fmt.Sprintf("max depth of %d reached", sm.MaxDepth))
+		return skipDepth
+	case sm.MaxPages > 0 && queued >= sm.MaxPages:
+		sm.truncate(fmt.Sprintf("max pages of %d reached", sm.MaxPages))
+		return skipPages
+	}
+	return ""
+}
+
+// truncate records the crawl as cut short for reason unless it already was.
+// The caller must hold sm.mu.
+func (sm *SiteMap) truncate(reason string) {
+	if sm.truncated == "" {
+		sm.truncated = reason
+	}
+}
@@ -0,0 +1,120 @@
+package mapper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStartMaxDepth(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.MaxDepth = 1
+	if err := sm.Start(context.Background()); err != nil {
+		t.Errorf("Start error: %v", err)
+	}
+
+	wantSkipped := map[string]string{
+		"/":            "",
+		"/hello-world": "",
+		"/values":      "",
+		"/variables":   skipDepth,
+		"/play.png":    "",
+		"/site.css":    "",
+	}
+	if got, want := len(sm.pages), len(wantSkipped); got != want {
+		t.Errorf("Got %d pages, want %d", got, want)
+	}
+	for path, p := range sm.pages {
+		want, ok := wantSkipped[path]
+		if !ok {
+			t.Errorf("Got unwanted path %q", path)
+			continue
+		}
+		if p.skipped != want {
+			t.Errorf("Path %q got skipped %q, want %q", path, p.skipped, want)
+		}
+	}
+	if got, want := sm.Truncated(), "max depth of 1 reached"; got != want {
+		t.Errorf("Got truncated %q, want %q", got, want)
+	}
+
+	// raising the limit resumes the crawl from the skipped pages
+	sm.MaxDepth = 0
+	if err := sm.Start(context.Background()); err != nil {
+		t.Errorf("Start error: %v", err)
+	}
+	if p := sm.pages["/constants"]; p == nil || !p.visited {
+		t.Error("Page /constants not visited without a max depth")
+	}
+	if got := sm.Truncated(); got != "" {
+		t.Errorf("Got truncated %q without limits", got)
+	}
+}
+
+func TestStartMaxPages(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.MaxPages = 3
+	if err := sm.Start(context.Background()); err != nil {
+		t.Errorf("Start error: %v", err)
+	}
+
+	visited := 0
+	for path, p := range sm.pages {
+		switch {
+		case p.visited:
+			visited++
+		case p.skipped != skipPages:
+			t.Errorf("Unvisited path %q got skipped %q, want %q", path, p.skipped, skipPages)
+		}
+	}
+	if visited != 3 {
+		t.Errorf("Got %d pages visited, want 3", visited)
+	}
+	if got, want := sm.Truncated(), "max pages of 3 reached"; got != want {
+		t.Errorf("Got truncated %q, want %q", got, want)
+	}
+}
+
+func TestStartTimeout(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	sm, err := NewSiteMap(server.URL, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.IgnoreRobots = true
+	sm.Timeout = 50 * time.Millisecond
+	if err := sm.Start(context.Background()); err != nil {
+		t.Errorf("Start error: %v", err)
+	}
+
+	if got := sm.Truncated(); !strings.HasPrefix(got, "timeout of") {
+		t.Errorf("Got truncated %q, want a timeout", got)
+	}
+	if sm.pages[sm.start].visited {
+		t.Error("Start page visited after the timeout")
+	}
+	if got, want := sm.state, stateFinished; got != want {
+		t.Errorf("Got state %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,169 @@
+package mapper
+
+import (
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// QueryPolicy decides which query parameters are kept in the path a page is
+// keyed by.
+type QueryPolicy string
+
+// The query parameter policies, QueryDropAll is the default.
+const (
+	QueryDropAll       QueryPolicy = ""
+	QueryKeepAll       QueryPolicy = "keep"
+	QueryAllowlist     QueryPolicy = "allowlist"      // keep only the parameters in Normalizer.QueryAllow
+	QueryStripTracking QueryPolicy = "strip-tracking" // keep all but the trackingParams
+)
+
+// defaultIndexNames are the file names folded into their directory by
+// Normalizer.FoldIndex when Normalizer.IndexNames is empty.
+var defaultIndexNames = []string{"index.html", "index.htm", "index.php"}
+
+// trackingParams are the query parameters dropped by QueryStripTracking, those
+// ending in "_" are prefixes.
+var trackingParams = []string{"utm_", "gclid", "fbclid", "msclkid", "dclid", "yclid", "mc_cid", "mc_eid", "_ga", "_gl"}
+
+var duplicateSlashes = regexp.MustCompile("/{2,}")
+
+// Normalizer configures how the URLs of links are normalized into the site
+// relative paths pages are keyed by, so different spellings of a URL are
+// crawled as a single page. The zero value keys pages by their path alone
+// with no other normalization.
+type Normalizer struct {
+	// FoldTrailingSlash removes a trailing slash so /site/ and /site are
+	// the same page.
+	FoldTrailingSlash bool
+	// LowercaseHost compares hosts ignoring case.
+	LowercaseHost bool
+	// StripDefaultPort removes :80 from http and :443 from https hosts.
+	StripDefaultPort bool
+	// CollapseSlashes replaces repeated slashes in a path with one.
+	CollapseSlashes bool
+	// NormalizeEncoding re-encodes each path so only the characters which
+	// must be are percent-encoded, using upper case hex digits.
+	NormalizeEncoding bool
+	// FoldIndex removes index file names, /dir/index.html becomes /dir/.
+	FoldIndex bool
+	// IndexNames are the file names removed by FoldIndex, if empty
+	// index.html, index.htm and index.php are used.
+	IndexNames []string
+	// Query selects which query parameters are kept, the parameters kept are
+	// sorted so their order doesn't matter.
+	Query QueryPolicy
+	// QueryAllow lists the query parameters kept with QueryAllowlist.
+	QueryAllow []string
+}
+
+// host returns the host of u normalized for comparison.
+func (n *Normalizer) host(u *url.URL) string {
+	host := u.Host
+	if n == nil {
+		return host
+	}
+	if n.LowercaseHost {
+		host = strings.ToLower(host)
+	}
+	if n.StripDefaultPort {
+		switch {
+		case u.Scheme == "http" && strings.HasSuffix(host, ":80"):
+			host = strings.TrimSuffix(host, ":80")
+		case u.Scheme == "https" && strings.HasSuffix(host, ":443"):
+			host = strings.TrimSuffix(host, ":443")
+		}
+	}
+	return host
+}
+
+// key returns the site relative path, with any query parameters kept, which
+// u is keyed by.
+func (n *Normalizer) key(u *url.URL) string {
+	if n == nil {
+		n = &Normalizer{}
+	}
+	p := *u
+	if n.NormalizeEncoding {
+		p.RawPath = ""
+	}
+	if n.CollapseSlashes {
+		p.Path = duplicateSlashes.ReplaceAllString(p.Path, "/")
+		p.RawPath = duplicateSlashes.ReplaceAllString(p.RawPath, "/")
+	}
+	if n.FoldIndex {
+		names := n.IndexNames
+		if len(names) == 0 {
+			names = defaultIndexNames
+		}
+		base := path.Base(p.Path)
+		for _, name := range names {
+			if base == name && strings.HasSuffix(p.Path, "/"+name) {
+				p.Path = strings.TrimSuffix(p.Path, name)
+				p.RawPath = strings.TrimSuffix(p.RawPath, name)
+				break
+			}
+		}
+	}
+	if n.FoldTrailingSlash && len(p.Path) > 1 && strings.HasSuffix(p.Path, "/") {
+		p.Path = strings.TrimRight(p.Path, "/")
+		p.RawPath = strings.TrimRight(p.RawPath, "/")
+		if p.Path == "" {
+			p.Path, p.RawPath = "/", ""
+		}
+	}
+	key := p.EscapedPath()
+	if key == "" {
+		key = "/"
+	}
+	if query := n.query(p.Query()); query != "" {
+		key += "?" + query
+	}
+	return key
+}
+
+// query returns the encoded query parameters kept by n.Query, sorted by key.
+// The values of a repeated parameter keep their order, which may be
+// significant to the site.
+func (n *Normalizer) query(values url.Values) string {
+	switch n.Query {
+	case QueryKeepAll:
+	case QueryAllowlist:
+		for key := range values {
+			if !containsString(n.QueryAllow, key) {
+				delete(values, key)
+			}
+		}
+	case QueryStripTracking:
+		for key := range values {
+			if isTrackingParam(key) {
+				delete(values, key)
+			}
+		}
+	default:
+		return ""
+	}
+	return values.Encode() // Encode sorts by key only
+}
+
+// isTrackingParam reports if the query parameter key is used for tracking.
+func isTrackingParam(key string) bool {
+	key = strings.ToLower(key)
+	for _, param := range trackingParams {
+		if key == param || (strings.HasSuffix(param, "_") && strings.HasPrefix(key, param)) {
+			return true
+		}
+	}
+	return false
+}
+
+// containsString reports if list contains s.
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+package mapper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestNormalizerKey(t *testing.T) {
+	tests := []struct {
+		n    Normalizer
+		link string
+		want string
+	}{
+		{link: "http://testhost.com", want: "/"},
+		{link: "http://testhost.com/a/?b=1#c", want: "/a/"},
+		{link: "http://testhost.com/%7euser", want: "/%7euser"},
+		{n: Normalizer{NormalizeEncoding: true}, link: "http://testhost.com/%7euser/a%2fb", want: "/~user/a/b"},
+		{n: Normalizer{FoldTrailingSlash: true}, link: "http://testhost.com/a/", want: "/a"},
+		{n: Normalizer{FoldTrailingSlash: true}, link: "http://testhost.com/", want: "/"},
+		{n: Normalizer{CollapseSlashes: true}, link: "http://testhost.com//a///b", want: "/a/b"},
+		{n: Normalizer{FoldIndex: true}, link: "http://testhost.com/a/index.html", want: "/a/"},
+		{n: Normalizer{FoldIndex: true}, link: "http://testhost.com/a/myindex.html", want: "/a/myindex.html"},
+		{n: Normalizer{FoldIndex: true, FoldTrailingSlash: true}, link: "http://testhost.com/a/index.php", want: "/a"},
+		{n: Normalizer{FoldIndex: true, IndexNames: []string{"default.aspx"}}, link: "http://testhost.com/default.aspx", want: "/"},
+		{n: Normalizer{Query: QueryKeepAll}, link: "http://testhost.com/s?z=1&a=2&a=1", want: "/s?a=2&a=1&z=1"},
+		{n: Normalizer{Query: QueryKeepAll}, link: "http://testhost.com/s?a=1&z=1&a=2", want: "/s?a=1&a=2&z=1"},
+		{n: Normalizer{Query: QueryAllowlist, QueryAllow: []string{"page"}}, link: "http://testhost.com/s?page=2&sort=asc", want: "/s?page=2"},
+		{n: Normalizer{Query: QueryStripTracking}, link: "http://testhost.com/s?page=2&utm_source=x&gclid=y", want: "/s?page=2"},
+		{n: Normalizer{Query: QueryStripTracking}, link: "http://testhost.com/s?utm_source=x", want: "/s"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.link)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := test.n.key(u); got != test.want {
+			t.Errorf("Link %q with %+v - got %q, want %q", test.link, test.n, got, test.want)
+		}
+	}
+}
+
+func TestFilterLinkNormalized(t *testing.T) {
+	p := newPage(&url.URL{Scheme: "http", Host: "testhost.com", Path: "/test/"})
+	n := &Normalizer{FoldTrailingSlash: true, LowercaseHost: true, StripDefaultPort: true, Query: QueryKeepAll}
+	tests := []struct {
+		link     string
+		want     string
+		wantOkay bool
+	}{
+		{link: "http://TestHost.com:80/other/", want: "/other", wantOkay: true},
+		{link: "https://testhost.com:443/other", want: "/other", wantOkay: true},
+		{link: "http://testhost.com:8080/other", wantOkay: false},
+		{link: "/test", wantOkay: false},
+		{link: "/test?page=2", want: "/test?page=2", wantOkay: true},
+	}
+	for _, test := range tests {
+		link, okay := p.filterLink(test.link, n, nil)
+		if okay != test.wantOkay || link != test.want {
+			t.Errorf("Test %q - got %q %t, want %q %t", test.link, link, okay, test.want, test.wantOkay)
+		}
+	}
+}
+
+func TestStartNormalized(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/docs/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		switch r.URL.Path {
+		case "/docs/":
+			w.Write([]byte(`<a href="/docs/index.html">home</a><a href="intro/?utm_source=nav">intro</a><a href="intro?page=2">intro 2</a>`))
+		case "/docs/intro/":
+			w.Write([]byte(`<a href="/docs">docs</a>`))
+		}
+	})
+	mux.Handle("/docs/intro", http.RedirectHandler("/docs/intro/", http.StatusMovedPermanently))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/docs/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.IgnoreRobots = true
+	sm.Normalization = Normalizer{FoldTrailingSlash: true, FoldIndex: true, Query: QueryStripTracking}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]int{
+		"/docs":              {"/docs/intro": 1, "/docs/intro?page=2": 1},
+		"/docs/intro":        {"/docs": 1},
+		"/docs/intro?page=2": {}, // the redirect handler drops the query
+	}
+	got := map[string]map[string]int{}
+	for path, p := range sm.pages {
+		got[path] = p.links
+		if p.broken {
+			t.Errorf("Page %q is broken", path)
+		}
+	}
+	if redirect := sm.pages["/docs/intro?page=2"].redirect; redirect != "/docs/intro" {
+		t.Errorf("Got redirect %q, want /docs/intro", redirect)
+	}
+	if redirect := sm.pages["/docs/intro"].redirect; redirect != "" {
+		t.Errorf("Got redirect %q for a trailing slash redirect", redirect)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got pages %v, want %v", got, want)
+	}
+	if sm.start != "/docs" {
+		t.Errorf("Got start %q, want /docs", sm.start)
+	}
+}
@@ -1,36 +1,200 @@
 package mapper
 
-import "net/url"
+import (
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// skipRobots is the skipped reason for pages disallowed by robots.txt.
+const skipRobots = "blocked by robots"
+
+// The kinds of link found on a page. Navigation links lead to pages which are
+// crawled for further links, resource links to images, scripts, etc. which are
+// only checked.
+const (
+	linkAnchor     = "link"
+	linkAlternate  = "alternate"
+	linkCanonical  = "canonical"
+	linkForm       = "form"
+	linkIframe     = "iframe"
+	linkRefresh    = "refresh"
+	linkIcon       = "icon"
+	linkImage      = "image"
+	linkMedia      = "media"
+	linkPreload    = "preload"
+	linkScript     = "script"
+	linkStylesheet = "stylesheet"
+)
+
+// link is a URL found on a page along with its kind.
+type link struct {
+	url  string
+	kind string
+}
+
+// isResource reports if a link kind refers to a resource rather than a page.
+func isResource(kind string) bool {
+	switch kind {
+	case linkIcon, linkImage, linkMedia, linkPreload, linkScript, linkStylesheet:
+		return true
+	}
+	return false
+}
 
 // page represents a single page within the site map. It tracks the links
 // to the from this page to other paths on the same site.
 type page struct {
-	broken  bool
-	links   map[string]int // string is the relative path, int a count of the number of links
-	url     *url.URL
-	visited bool
-	err     error
+	broken    bool
+	canonical string            // the URL of the rel=canonical link on the page
+	depth     int               // clicks from the starting page along the shortest path found
+	duration  time.Duration     // wall clock time to fetch and read the page
+	errClass  string            // the class of err, one of the error* constants
+	external  map[string]int    // links to other sites by URL, recorded only when they are checked
+	finalURL  *url.URL          // where the redirect chain ends, nil if there were no redirects
+	findings  []string          // notable issues which don't make the page broken
+	header    http.Header       // only the response headers in recordedHeaders
+	kinds     map[string]string // the link kind for each of links, navigation kinds win over resources
+	links     map[string]int    // string is the relative path, int a count of the number of links
+	redirect  string            // the relative path of the redirect target when on the same site
+	redirects []redirect
+	resource  bool   // only linked to as a resource, it is checked with a HEAD request and not parsed
+	retries   int    // times the page was visited again after a transient error
+	retry     bool   // the error is transient so the page may be visited again
+	size      int64  // bytes read from the response body
+	skipped   string // the reason an unvisited page was not crawled
+	status    int    // the HTTP status code, 0 if no response was received
+	url       *url.URL
+	visited   bool
+	err       error
+}
+
+// redirect is a single hop in a chain of HTTP redirects.
+type redirect struct {
+	StatusCode int    `json:"status"`
+	URL        string `json:"url"`      // the URL requested
+	Location   string `json:"location"` // the Location response header resolved against URL
 }
 
 // newPage returns a new unvisited page.
 func newPage(url *url.URL) *page {
-	return &page{links: map[string]int{}, url: url}
+	return &page{external: map[string]int{}, kinds: map[string]string{}, links: map[string]int{}, url: url}
+}
+
+// clone returns a copy of p whose links, findings and redirects can be
+// modified without affecting p.
+func (p *page) clone() *page {
+	c := *p
+	c.kinds = make(map[string]string, len(p.kinds))
+	for path, kind := range p.kinds {
+		c.kinds[path] = kind
+	}
+	c.external = make(map[string]int, len(p.external))
+	for u, count := range p.external {
+		c.external[u] = count
+	}
+	c.links = make(map[string]int, len(p.links))
+	for path, count := range p.links {
+		c.links[path] = count
+	}
+	c.findings = append([]string(nil), p.findings...)
+	c.redirects = append([]redirect(nil), p.redirects...)
+	return &c
+}
+
+// reset clears the results of any previous visit from p.
+func (p *page) reset() {
+	*p = page{depth: p.depth, external: map[string]int{}, kinds: map[string]string{}, links: map[string]int{}, resource: p.resource, url: p.url}
+}
+
+// addLinks will filter out any self links and links outside the crawled sites
+// then add what remains to p.Links as anchor links.
+func (p *page) addLinks(links []string, n *Normalizer, sites *siteHosts) {
+	for _, l := range links {
+		p.addLink(link{url: l, kind: linkAnchor}, n, sites)
+	}
+}
+
+// addLink adds l to p.links and its kind to p.kinds if it is not filtered.
+// A navigation kind replaces a resource kind already recorded for the path.
+func (p *page) addLink(l link, n *Normalizer, sites *siteHosts) {
+	linkPath, ok := p.filterLink(l.url, n, sites)
+	if !ok {
+		return
+	}
+	p.links[linkPath]++
+	if p.kinds == nil {
+		p.kinds = map[string]string{}
+	}
+	if kind, ok := p.kinds[linkPath]; !ok || (isResource(kind) && !isResource(l.kind)) {
+		p.kinds[linkPath] = l.kind
+	}
+}
+
+// nonCanonical reports if p declares a different page as its canonical URL,
+// comparing the keys the pages have when normalized by n on sites, nil for
+// only the host of p. The scheme is ignored so http and https versions are
+// the same page.
+func (p *page) nonCanonical(n *Normalizer, sites *siteHosts) bool {
+	if p.canonical == "" {
+		return false
+	}
+	u, err := p.url.Parse(p.canonical)
+	if err != nil {
+		return false
+	}
+	if sites == nil {
+		sites = &siteHosts{hosts: []string{n.host(p.url)}}
+	}
+	canonical, ok := sites.key(u, n)
+	self, _ := sites.key(p.url, n)
+	return !ok || canonical != self
 }
 
-// addLinks will filter out any self links and links outside the base site
-// then add what remains to p.Links
-func (p *page) addLinks(links []string) {
-	for _, link := range links {
-		if linkPath, ok := p.filterLink(link); ok {
-			p.links[linkPath]++
-		}
+// redirected reports if p redirects to a page other than itself, comparing
+// the keys the pages have when normalized by n on sites, nil for only the
+// host of p. A redirect such as one adding a trailing slash folded by n is to
+// the page itself.
+func (p *page) redirected(n *Normalizer, sites *siteHosts) bool {
+	if p.redirect != "" {
+		return true
 	}
+	if p.finalURL == nil {
+		return false
+	}
+	if sites == nil {
+		sites = &siteHosts{hosts: []string{n.host(p.url)}}
+	}
+	final, ok := sites.key(p.finalURL, n)
+	self, _ := sites.key(p.url, n)
+	return !ok || final != self
+}
+
+// linkKind returns the kind of the link from p to path, links recorded
+// without a kind are anchors.
+func (p *page) linkKind(path string) string {
+	if kind, ok := p.kinds[path]; ok {
+		return kind
+	}
+	return linkAnchor
 }
 
-// filterLink will normalize the link url, filter out self links and links to
-// a different host and then return the relative path portion of the URL.
-// If a link is filtered the bool is set to false.
-func (p *page) filterLink(link string) (string, bool) {
+// resourceLinks returns which of the links from p are to resources.
+func (p *page) resourceLinks() map[string]bool {
+	resources := map[string]bool{}
+	for path := range p.links {
+		resources[path] = isResource(p.linkKind(path))
+	}
+	return resources
+}
+
+// filterLink will normalize the link url with n, filter out self links and
+// links to hosts other than those of the sites and then return the key of the
+// linked page, the relative path portion of the URL including any query
+// parameters n keeps for links to the first site. If a link is filtered the
+// bool is set to false. A nil n only removes the query and fragment, nil
+// sites allows only links to the host of p.
+func (p *page) filterLink(link string, n *Normalizer, sites *siteHosts) (string, bool) {
 	linkURL, err := url.Parse(link)
 	if err != nil {
 		// TODO I need to consider some debug logging
@@ -39,15 +203,16 @@ func (p *page) filterLink(link string) (string, bool) {
 	if linkURL.Scheme == "" {
 		linkURL = p.url.ResolveReference(linkURL)
 	}
-	if linkURL.Path == "" {
-		linkURL.Path = "/"
-	}
 	if linkURL.Scheme != "http" && linkURL.Scheme != "https" {
 		return "", false
 	}
-	if linkURL.Host != p.url.Host || linkURL.Path == p.url.Path {
+	if sites == nil {
+		sites = &siteHosts{hosts: []string{n.host(p.url)}}
+	}
+	linkPath, ok := sites.key(linkURL, n)
+	if self, _ := sites.key(p.url, n); !ok || linkPath == self {
 		return "", false
 	}
 
-	return linkURL.Path, true
+	return linkPath, true
 }
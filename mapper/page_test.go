@@ -23,7 +23,7 @@ func TestAddLinks(t *testing.T) {
 	}
 
 	p := newPage(testPageURL)
-	p.addLinks(testLinks)
+	p.addLinks(testLinks, nil, nil)
 
 	if !reflect.DeepEqual(p.links, wantLinks) {
 		t.Errorf("Got links %+v, want %+v", p.links, wantLinks)
@@ -100,7 +100,7 @@ func TestFilterLink(t *testing.T) {
 
 	p := newPage(testPageURL)
 	for _, test := range tests {
-		link, okay := p.filterLink(test.link)
+		link, okay := p.filterLink(test.link, nil, nil)
 		switch {
 		case okay != test.wantOkay:
 			t.Errorf("Test %q - got okay %t, want %t", test.link, okay, test.wantOkay)
@@ -109,3 +109,35 @@ func TestFilterLink(t *testing.T) {
 		}
 	}
 }
+
+func TestNonCanonical(t *testing.T) {
+	tests := []struct {
+		page, canonical string
+		n               Normalizer
+		want            bool
+	}{
+		{"https://example.com/docs", "https://example.com/docs", Normalizer{}, false},
+		{"https://example.com/docs", "http://example.com/docs", Normalizer{}, false},
+		{"https://example.com/docs", "/docs", Normalizer{}, false},
+		{"https://example.com/docs", "https://example.com/other", Normalizer{}, true},
+		{"https://example.com/docs", "https://other.com/docs", Normalizer{}, true},
+		{"https://example.com/docs", "https://example.com/docs/", Normalizer{}, true},
+		{"https://example.com/docs", "https://example.com/docs/", Normalizer{FoldTrailingSlash: true}, false},
+		{"https://example.com/a", "https://EXAMPLE.com:443/a", Normalizer{LowercaseHost: true, StripDefaultPort: true}, false},
+		{"https://example.com/docs/", "https://example.com/docs/index.html", Normalizer{FoldIndex: true}, false},
+		{"https://example.com/search?page=1", "/search", Normalizer{}, false},
+		{"https://example.com/search?page=1", "/search", Normalizer{Query: QueryKeepAll}, true},
+		{"https://example.com/search?b=2&a=1", "/search?a=1&b=2", Normalizer{Query: QueryKeepAll}, false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p := newPage(u)
+		p.canonical = test.canonical
+		if got := p.nonCanonical(&test.n, nil); got != test.want {
+			t.Errorf("Page %s with canonical %s and %+v got non-canonical %t, want %t", test.page, test.canonical, test.n, got, test.want)
+		}
+	}
+}
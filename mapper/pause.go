@@ -0,0 +1,114 @@
+package mapper
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync"
+)
+
+// pauser holds the crawling go routines while a crawl is paused. The zero
+// value is not paused.
+type pauser struct {
+	mu     sync.Mutex
+	paused chan struct{} // closed on resume, nil when not paused
+}
+
+// pause holds the crawling go routines at their next wait.
+func (p *pauser) pause() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused == nil {
+		p.paused = make(chan struct{})
+	}
+}
+
+// resume releases the crawling go routines held by wait.
+func (p *pauser) resume() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused != nil {
+		close(p.paused)
+		p.paused = nil
+	}
+}
+
+// wait blocks while p is paused or until ctx is done. A nil pauser never
+// waits.
+func (p *pauser) wait(ctx context.Context) {
+	if p == nil {
+		return
+	}
+	p.mu.Lock()
+	paused := p.paused
+	p.mu.Unlock()
+	if paused == nil {
+		return
+	}
+	select {
+	case <-paused:
+	case <-ctx.Done():
+	}
+}
+
+// Pause pauses a running crawl. Pages being fetched are finished but no new
+// fetches begin until Resume is called, the pages not yet visited remain
+// queued. The crawl's deadline, if Timeout is set, still applies.
+func (sm *SiteMap) Pause() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.state != stateCrawling {
+		return fmt.Errorf("cannot pause a crawl which is %s", sm.state)
+	}
+	sm.pauser.pause()
+	sm.updateState(statePaused)
+	return nil
+}
+
+// Resume continues a crawl paused by Pause.
+func (sm *SiteMap) Resume() error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.state != statePaused {
+		return fmt.Errorf("cannot resume a crawl which is %s", sm.state)
+	}
+	sm.pauser.resume()
+	sm.updateState(stateCrawling)
+	return nil
+}
+
+// CrawlHandler returns an http.Handler controlling the crawl, a POST to a
+// path ending in /pause pauses it and to one ending in /resume resumes it.
+// The response is JSON with the resulting state of the crawl.
+func (sm *SiteMap) CrawlHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var action func() error
+		switch path.Base(r.URL.Path) {
+		case "pause":
+			action = sm.Pause
+		case "resume":
+			action = sm.Resume
+		default:
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, fmt.Sprintf("%s is not allowed, use POST", r.Method), http.StatusMethodNotAllowed)
+			return
+		}
+		if err := action(); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+		sm.mu.RLock()
+		state := sm.state
+		sm.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(struct {
+			State string `json:"state"`
+		}{state})
+	})
+}
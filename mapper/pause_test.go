@@ -0,0 +1,111 @@
+package mapper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPauseResume(t *testing.T) {
+	var mu sync.Mutex
+	requests := 0
+	first, release := make(chan struct{}), make(chan struct{})
+	files := http.FileServer(http.Dir("testdata"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests++
+		n := requests
+		mu.Unlock()
+		if n == 1 {
+			close(first)
+			<-release
+		}
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.IgnoreRobots = true
+	done := make(chan error)
+	go func() { done <- sm.Start(context.Background()) }()
+
+	<-first
+	if err := sm.Pause(); err != nil {
+		t.Fatalf("Pause error: %v", err)
+	}
+	if err := sm.Pause(); err == nil {
+		t.Error("Pausing a paused crawl succeeded")
+	}
+	close(release)
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	if requests != 1 {
+		t.Errorf("Got %d requests while paused, want only the one in flight", requests)
+	}
+	mu.Unlock()
+	sm.mu.RLock()
+	if got, want := sm.state, statePaused; got != want {
+		t.Errorf("Got state %q, want %q", got, want)
+	}
+	sm.mu.RUnlock()
+
+	if err := sm.Resume(); err != nil {
+		t.Fatalf("Resume error: %v", err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Start error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Start did not finish after the crawl was resumed")
+	}
+	for path, p := range sm.pages {
+		if !p.visited {
+			t.Errorf("Path %q unvisited after resuming", path)
+		}
+	}
+	if got, want := sm.state, stateFinished; got != want {
+		t.Errorf("Got state %q, want %q", got, want)
+	}
+}
+
+func TestCrawlHandler(t *testing.T) {
+	sm, err := NewSiteMap("http://testsite.com", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := sm.CrawlHandler()
+
+	tests := []struct {
+		method     string
+		path       string
+		state      string
+		wantStatus int
+		wantState  string
+	}{
+		{http.MethodGet, "/crawl/pause", stateCrawling, http.StatusMethodNotAllowed, stateCrawling},
+		{http.MethodPost, "/crawl/stop", stateCrawling, http.StatusNotFound, stateCrawling},
+		{http.MethodPost, "/crawl/pause", stateFinished, http.StatusConflict, stateFinished},
+		{http.MethodPost, "/crawl/pause", stateCrawling, http.StatusOK, statePaused},
+		{http.MethodPost, "/crawl/resume", statePaused, http.StatusOK, stateCrawling},
+	}
+	for _, test := range tests {
+		sm.setState(test.state)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(test.method, test.path, nil))
+		if w.Code != test.wantStatus {
+			t.Errorf("%s %s when %s got status %d, want %d", test.method, test.path, test.state, w.Code, test.wantStatus)
+		}
+		if sm.state != test.wantState {
+			t.Errorf("%s %s when %s got state %q, want %q", test.method, test.path, test.state, sm.state, test.wantState)
+		}
+	}
+	sm.pauser.resume()
+}
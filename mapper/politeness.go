@@ -0,0 +1,229 @@
+package mapper
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	minBackoff = time.Second
+	maxBackoff = 5 * time.Minute // the longest wait after a 429 or 503 response, including Retry-After
+)
+
+// The reasons the crawler waits before a request, used to label the
+// throttledSeconds metric.
+const (
+	throttleBackoff     = "backoff"
+	throttleConnections = "connections"
+	throttleCrawlDelay  = "crawl_delay"
+	throttleRate        = "rate"
+)
+
+// hostLimiter enforces the politeness limits on the requests to each host,
+// a minimum interval between requests, a maximum number of concurrent
+// requests, the Crawl-delay of the host's robots.txt and backing off when the
+// host responds 429 Too Many Requests or 503 Service Unavailable. A zero
+// interval or connections is unlimited.
+type hostLimiter struct {
+	interval    time.Duration
+	connections int
+	mu          sync.Mutex
+	hosts       map[string]*hostLimit
+}
+
+// hostLimit is the state of the limits for a single host.
+type hostLimit struct {
+	throttle   throttle
+	crawlDelay throttle      // the Crawl-delay of the host's robots.txt
+	conns      chan struct{} // a slot is held by each request in progress, nil when unlimited
+	backoff    time.Duration // the last backoff without a Retry-After, doubled each time
+	until      time.Time     // when requests may resume after backing off
+}
+
+// limit returns the hostLimit for host, creating it when needed.
+func (l *hostLimiter) limit(host string) *hostLimit {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.hosts == nil {
+		l.hosts = map[string]*hostLimit{}
+	}
+	h, ok := l.hosts[host]
+	if !ok {
+		h = &hostLimit{throttle: throttle{interval: l.interval}}
+		if l.connections > 0 {
+			h.conns = make(chan struct{}, l.connections)
+		}
+		l.hosts[host] = h
+	}
+	return h
+}
+
+// acquire blocks until a request to host is allowed, returning a func which
+// must be called when the request is complete. An error is returned if ctx is
+// done first. A nil hostLimiter never waits.
+func (l *hostLimiter) acquire(ctx context.Context, host string) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	h := l.limit(host)
+	release := func() {}
+	if h.conns != nil {
+		start := time.Now()
+		select {
+		case h.conns <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		throttled(throttleConnections, start)
+		var once sync.Once
+		release = func() { once.Do(func() { <-h.conns }) }
+	}
+
+	l.mu.Lock()
+	until := h.until
+	l.mu.Unlock()
+	if delay := time.Until(until); delay > 0 {
+		start := time.Now()
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+		timer.Stop()
+		throttled(throttleBackoff, start)
+	}
+
+	start := time.Now()
+	h.throttle.wait(ctx)
+	throttled(throttleRate, start)
+	start = time.Now()
+	h.crawlDelay.wait(ctx)
+	throttled(throttleCrawlDelay, start)
+	if err := ctx.Err(); err != nil {
+		release()
+		return nil, err
+	}
+	return release, nil
+}
+
+// setCrawlDelay sets the minimum interval between requests to host given by
+// the Crawl-delay of its robots.txt, the longer of it and the interval of l
+// applies.
+func (l *hostLimiter) setCrawlDelay(host string, delay time.Duration) {
+	if l == nil {
+		return
+	}
+	l.limit(host).crawlDelay.lengthen(delay)
+}
+
+// backOff delays further requests to host after it responded 429 or 503 with
+// the given Retry-After header. Without a valid Retry-After the delay starts
+// at minBackoff and doubles each time until the host responds successfully.
+func (l *hostLimiter) backOff(host, retryAfter string) {
+	h := l.limit(host)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delay, ok := parseRetryAfter(retryAfter, time.Now())
+	if !ok {
+		h.backoff *= 2
+		if h.backoff < minBackoff {
+			h.backoff = minBackoff
+		}
+		delay = h.backoff
+	}
+	if delay > maxBackoff {
+		delay = maxBackoff
+	}
+	if until := time.Now().Add(delay); until.After(h.until) {
+		h.until = until
+	}
+}
+
+// succeeded resets the backoff of host after a response which was not 429 or
+// 503.
+func (l *hostLimiter) succeeded(host string) {
+	h := l.limit(host)
+	l.mu.Lock()
+	h.backoff = 0
+	l.mu.Unlock()
+}
+
+// parseRetryAfter returns the delay of a Retry-After header, given either in
+// seconds or as an HTTP date, false if it is missing or invalid.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if delay := date.Sub(now); delay > 0 {
+		return delay, true
+	}
+	return 0, true
+}
+
+// throttled adds the time since start to the throttledSeconds metric.
+func throttled(reason string, start time.Time) {
+	if d := time.Since(start); d > time.Millisecond {
+		throttledSeconds.WithLabelValues(reason).Add(d.Seconds())
+	}
+}
+
+// do sends req with c.client once c.limiter allows a request to its host.
+// When the host responds 429 or 503 further requests to it are backed off,
+// the page is retried by visitRetrying. The limiter's connection slot is
+// held until the body of the returned response is closed, when the exchange
+// is also written to c.warc if set.
+func (c *crawler) do(req *http.Request) (*http.Response, error) {
+	if c.limiter == nil {
+		resp, err := c.client.Do(req)
+		if err == nil && c.warc != nil {
+			c.warc.record(req, resp)
+		}
+		return resp, err
+	}
+	host := req.URL.Host
+	release, err := c.limiter.acquire(req.Context(), host)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	if c.warc != nil {
+		c.warc.record(req, resp)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+		c.limiter.backOff(host, resp.Header.Get("Retry-After"))
+	} else {
+		c.limiter.succeeded(host)
+	}
+	resp.Body = &releasingBody{ReadCloser: resp.Body, release: release}
+	return resp, nil
+}
+
+// releasingBody calls release once the response body is closed.
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
@@ -0,0 +1,244 @@
+package mapper
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	tests := []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-time.Hour).Format(http.TimeFormat), 0, true},
+	}
+	for _, test := range tests {
+		got, ok := parseRetryAfter(test.value, now)
+		if got != test.want || ok != test.ok {
+			t.Errorf("Retry-After %q got %v, %v want %v, %v", test.value, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestHostLimiterBackOff(t *testing.T) {
+	l := &hostLimiter{}
+	for _, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second} {
+		l.backOff("example.com", "")
+		if got := l.limit("example.com").backoff; got != want {
+			t.Errorf("Got backoff %v, want %v", got, want)
+		}
+	}
+	l.succeeded("example.com")
+	if got := l.limit("example.com").backoff; got != 0 {
+		t.Errorf("Got backoff %v after success, want 0", got)
+	}
+	if until := l.limit("other.com").until; !until.IsZero() {
+		t.Errorf("Got other.com backing off until %v", until)
+	}
+
+	l.backOff("example.com", "3600")
+	if delay := time.Until(l.limit("example.com").until); delay > maxBackoff {
+		t.Errorf("Got a backoff of %v, longer than the maximum %v", delay, maxBackoff)
+	}
+}
+
+func TestHostLimiterCrawlDelay(t *testing.T) {
+	l := &hostLimiter{}
+	l.setCrawlDelay("slow.com", 100*time.Millisecond)
+	ctx := context.Background()
+	timeRequests := func(host string) time.Duration {
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			release, err := l.acquire(ctx, host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			release()
+		}
+		return time.Since(start)
+	}
+	if got, want := timeRequests("slow.com"), 200*time.Millisecond; got < want {
+		t.Errorf("Requests to the host with a Crawl-delay took %v, want at least %v", got, want)
+	}
+	if got := timeRequests("fast.com"); got > 50*time.Millisecond {
+		t.Errorf("Requests to another host took %v, want no delay", got)
+	}
+}
+
+func TestStartCrawlDelayPerSite(t *testing.T) {
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/robots.txt":
+			fmt.Fprint(w, "User-agent: *\nCrawl-delay: 1\n")
+		case "/":
+			fmt.Fprint(w, `<a href="/b">b</a>`)
+		}
+	}))
+	defer slow.Close()
+	var mu sync.Mutex
+	var last time.Time // when the fast site last responded
+	pages := &pagesHandler{count: 4}
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pages.ServeHTTP(w, r)
+		mu.Lock()
+		last = time.Now()
+		mu.Unlock()
+	}))
+	defer fast.Close()
+
+	sm, err := NewSiteMap(fast.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.AddSite(slow.URL); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if got, want := time.Since(start), time.Second; got < want {
+		t.Errorf("Crawl took %v, want at least the slow site's Crawl-delay %v", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got := last.Sub(start); got > 500*time.Millisecond {
+		t.Errorf("The fast site took %v, slowed by the other site's Crawl-delay", got)
+	}
+}
+
+// pagesHandler serves a page at / linking to count other pages, each taking
+// delay to respond, and records the most requests in progress at once.
+type pagesHandler struct {
+	count  int
+	delay  time.Duration
+	mu     sync.Mutex
+	active int
+	max    int
+}
+
+func (h *pagesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	h.active++
+	if h.active > h.max {
+		h.max = h.active
+	}
+	h.mu.Unlock()
+	defer func() {
+		h.mu.Lock()
+		h.active--
+		h.mu.Unlock()
+	}()
+
+	switch r.URL.Path {
+	case "/":
+		for i := 0; i < h.count; i++ {
+			fmt.Fprintf(w, `<a href="/%d">%d</a>`, i, i)
+		}
+	case "/robots.txt":
+		http.NotFound(w, r)
+	default:
+		time.Sleep(h.delay)
+	}
+}
+
+func TestStartHostConnections(t *testing.T) {
+	h := &pagesHandler{count: 8, delay: 20 * time.Millisecond}
+	server := httptest.NewServer(h)
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.HostConnections = 2
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if got, want := len(sm.pages), h.count+1; got != want {
+		t.Errorf("Got %d pages, want %d", got, want)
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.max > sm.HostConnections {
+		t.Errorf("Got %d requests at once, more than %d", h.max, sm.HostConnections)
+	}
+}
+
+func TestStartHostRate(t *testing.T) {
+	server := httptest.NewServer(&pagesHandler{count: 4})
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.HostRate = 20
+	start := time.Now()
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	// robots.txt and 5 pages, the first request is not delayed
+	if got, want := time.Since(start), 5*50*time.Millisecond; got < want {
+		t.Errorf("Crawl took %v, want at least %v", got, want)
+	}
+}
+
+func TestStartBackOff(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<a href="/busy">busy</a><a href="/down">down</a>`)
+		case "/busy":
+			if n == 1 {
+				w.Header().Set("Retry-After", "0")
+				w.WriteHeader(http.StatusTooManyRequests)
+			}
+		case "/down":
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.RetryBackoff = time.Millisecond
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+
+	if p := sm.pages["/busy"]; p == nil || p.broken || p.status != http.StatusOK {
+		t.Errorf("Page /busy not retried after a 429, got %+v", p)
+	}
+	if p := sm.pages["/down"]; p == nil || !p.broken || p.status != http.StatusServiceUnavailable {
+		t.Errorf("Page /down not broken after repeated 503s, got %+v", p)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if got, want := requests["/down"], sm.Retries+1; got != want {
+		t.Errorf("Got %d requests for /down, want %d", got, want)
+	}
+}
@@ -0,0 +1,121 @@
+package mapper
+
+import (
+	"net/http"
+	"reflect"
+	"sort"
+)
+
+// RecrawlSummary describes how a site changed since a baseline crawl. Each
+// field lists the paths of the pages in that category, sorted.
+type RecrawlSummary struct {
+	Added     []string `json:"added"`
+	Removed   []string `json:"removed"`
+	Changed   []string `json:"changed"`
+	Unchanged []string `json:"unchanged"`
+}
+
+// conditionalHeader returns the If-None-Match and If-Modified-Since headers
+// for a conditional request based on the validators recorded for p. Nil is
+// returned if p is nil or was not successfully retrieved with validators.
+func (p *page) conditionalHeader() http.Header {
+	if p == nil || !p.visited || p.broken || len(p.redirects) > 0 || p.header == nil {
+		return nil
+	}
+	header := http.Header{}
+	if etag := p.header.Get("ETag"); etag != "" {
+		header.Set("If-None-Match", etag)
+	}
+	if modified := p.header.Get("Last-Modified"); modified != "" {
+		header.Set("If-Modified-Since", modified)
+	}
+	if len(header) == 0 {
+		return nil
+	}
+	return header
+}
+
+// notModified fills in p from the baseline page prev after the server
+// responded 304 Not Modified, reusing its links, canonical URL and findings.
+// Any validators in the 304 response replace those recorded for prev.
+func (p *page) notModified(prev *page, header http.Header) {
+	p.status = http.StatusNotModified
+	p.canonical = prev.canonical
+	p.findings = append(p.findings, prev.findings...)
+	p.size = prev.size
+	p.header = http.Header{}
+	for key, values := range prev.header {
+		p.header[key] = values
+	}
+	for key, value := range recordHeaders(header) {
+		p.header[key] = value
+	}
+	for path, count := range prev.links {
+		p.links[path] = count
+	}
+	for path, kind := range prev.kinds {
+		p.kinds[path] = kind
+	}
+	for u, count := range prev.external {
+		p.external[u] = count
+	}
+}
+
+// baselinePages returns a copy of the pages in sm.Baseline keyed by URL for
+// use by the crawler.
+func (sm *SiteMap) baselinePages() map[string]*page {
+	if sm.Baseline == nil {
+		return nil
+	}
+	sm.Baseline.mu.RLock()
+	defer sm.Baseline.mu.RUnlock()
+	pages := make(map[string]*page, len(sm.Baseline.pages))
+	for _, p := range sm.Baseline.pages {
+		pages[p.url.String()] = p.clone()
+	}
+	return pages
+}
+
+// RecrawlSummary compares sm with its Baseline returning the pages added,
+// removed, changed and unchanged. A page is unchanged if the server responded
+// 304 Not Modified or its status, links and redirect are the same as in the
+// baseline. Nil is returned if there is no Baseline.
+func (sm *SiteMap) RecrawlSummary() *RecrawlSummary {
+	if sm.Baseline == nil {
+		return nil
+	}
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.recrawlSummary()
+}
+
+// recrawlSummary implements RecrawlSummary, the caller must hold sm.mu.
+func (sm *SiteMap) recrawlSummary() *RecrawlSummary {
+	sm.Baseline.mu.RLock()
+	defer sm.Baseline.mu.RUnlock()
+
+	summary := &RecrawlSummary{Added: []string{}, Removed: []string{}, Changed: []string{}, Unchanged: []string{}}
+	for path, p := range sm.pages {
+		prev, ok := sm.Baseline.pages[path]
+		switch {
+		case !ok:
+			summary.Added = append(summary.Added, path)
+		case p.status == http.StatusNotModified:
+			summary.Unchanged = append(summary.Unchanged, path)
+		case p.status == prev.status && p.broken == prev.broken && p.redirect == prev.redirect &&
+			reflect.DeepEqual(p.links, prev.links):
+			summary.Unchanged = append(summary.Unchanged, path)
+		default:
+			summary.Changed = append(summary.Changed, path)
+		}
+	}
+	for path := range sm.Baseline.pages {
+		if _, ok := sm.pages[path]; !ok {
+			summary.Removed = append(summary.Removed, path)
+		}
+	}
+	for _, paths := range [][]string{summary.Added, summary.Removed, summary.Changed, summary.Unchanged} {
+		sort.Strings(paths)
+	}
+	return summary
+}
@@ -0,0 +1,133 @@
+package mapper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSite serves pages keyed by path with an ETag, counting the full
+// responses sent for each.
+type testSite struct {
+	mu    sync.Mutex
+	pages map[string]string
+	etags map[string]string
+	full  map[string]int
+}
+
+func (ts *testSite) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ts.mu.Lock()
+	body, ok := ts.pages[r.URL.Path]
+	etag := ts.etags[r.URL.Path]
+	ts.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Content-Type", "text/html")
+	if r.Header.Get("If-None-Match") != etag {
+		ts.mu.Lock()
+		ts.full[r.URL.Path]++
+		ts.mu.Unlock()
+	}
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(body))
+}
+
+func TestRecrawl(t *testing.T) {
+	site := &testSite{
+		pages: map[string]string{
+			"/":  `<html><a href="/a">a</a><a href="/b">b</a></html>`,
+			"/a": `<html><a href="/">home</a></html>`,
+			"/b": `<html><a href="/">home</a></html>`,
+		},
+		etags: map[string]string{"/": `"1"`, "/a": `"1"`, "/b": `"1"`},
+		full:  map[string]int{},
+	}
+	server := httptest.NewServer(site)
+	defer server.Close()
+
+	baseline, err := NewSiteMap(server.URL+"/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseline.IgnoreRobots = true
+	if err := baseline.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if summary := baseline.RecrawlSummary(); summary != nil {
+		t.Errorf("Got summary %v without a baseline", summary)
+	}
+
+	site.mu.Lock()
+	site.pages["/"] = `<html><a href="/a">a</a><a href="/c">c</a></html>`
+	site.etags["/"] = `"2"`
+	site.pages["/c"] = `<html></html>`
+	site.etags["/c"] = `"1"`
+	site.full = map[string]int{}
+	site.mu.Unlock()
+
+	sm, err := NewSiteMap(server.URL+"/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.IgnoreRobots = true
+	sm.Baseline = baseline
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]int{"/": 1, "/c": 1}; !reflect.DeepEqual(site.full, want) {
+		t.Errorf("Got full responses %v, want %v", site.full, want)
+	}
+	a := sm.pages["/a"]
+	if a.status != http.StatusNotModified {
+		t.Errorf("Page /a got status %d, want 304", a.status)
+	}
+	if want := map[string]int{"/": 1}; !reflect.DeepEqual(a.links, want) {
+		t.Errorf("Page /a got links %v, want %v", a.links, want)
+	}
+	if a.header.Get("ETag") != `"1"` {
+		t.Errorf("Page /a got ETag %q", a.header.Get("ETag"))
+	}
+	if _, ok := sm.pages["/b"]; ok {
+		t.Error("Unreachable page /b was kept")
+	}
+
+	want := &RecrawlSummary{
+		Added:     []string{"/c"},
+		Removed:   []string{"/b"},
+		Changed:   []string{"/"},
+		Unchanged: []string{"/a"},
+	}
+	if got := sm.RecrawlSummary(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got summary %+v, want %+v", got, want)
+	}
+}
+
+func TestConditionalHeader(t *testing.T) {
+	var nilPage *page
+	if header := nilPage.conditionalHeader(); header != nil {
+		t.Errorf("Got header %v for a nil page", header)
+	}
+
+	p := &page{visited: true, header: http.Header{}}
+	if header := p.conditionalHeader(); header != nil {
+		t.Errorf("Got header %v for a page without validators", header)
+	}
+	p.header.Set("ETag", `"x"`)
+	p.header.Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+	want := http.Header{"If-None-Match": {`"x"`}, "If-Modified-Since": {"Mon, 02 Jan 2006 15:04:05 GMT"}}
+	if header := p.conditionalHeader(); !reflect.DeepEqual(header, want) {
+		t.Errorf("Got header %v, want %v", header, want)
+	}
+	p.broken = true
+	if header := p.conditionalHeader(); header != nil {
+		t.Errorf("Got header %v for a broken page", header)
+	}
+}
@@ -0,0 +1,152 @@
+package mapper
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// BrokenPage describes a broken page within a SiteMap along with every page
+// which links or redirects to it.
+type BrokenPage struct {
+	Path       string
+	URL        string
+	Status     int // the HTTP status code, 0 if no response was received
+	Error      string
+	Class      string   // the class of error, ie timeout or http_4xx
+	LinkedFrom []string // the paths of the pages linking to this one
+}
+
+// BrokenPages returns the broken pages in sm sorted by path.
+func (sm *SiteMap) BrokenPages() []BrokenPage {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.brokenPages()
+}
+
+// brokenPages implements BrokenPages, the caller must hold sm.mu.
+func (sm *SiteMap) brokenPages() []BrokenPage {
+	broken := map[string]*BrokenPage{}
+	for path, p := range sm.pages {
+		if !p.broken {
+			continue
+		}
+		bp := &BrokenPage{Path: path, URL: p.url.String(), Status: p.status, Class: p.errClass}
+		if p.err != nil {
+			bp.Error = p.err.Error()
+		}
+		broken[path] = bp
+	}
+	for path, p := range sm.pages {
+		for link := range p.links {
+			if bp, ok := broken[link]; ok {
+				bp.LinkedFrom = append(bp.LinkedFrom, path)
+			}
+		}
+		if bp, ok := broken[p.redirect]; ok {
+			bp.LinkedFrom = append(bp.LinkedFrom, path)
+		}
+	}
+
+	pages := make([]BrokenPage, 0, len(broken))
+	for _, bp := range broken {
+		sort.Strings(bp.LinkedFrom)
+		pages = append(pages, *bp)
+	}
+	sort.Slice(pages, func(i, j int) bool { return pages[i].Path < pages[j].Path })
+	return pages
+}
+
+// WriteBrokenReport writes a human readable report of the broken pages to w.
+func WriteBrokenReport(w io.Writer, broken []BrokenPage) error {
+	for _, bp := range broken {
+		if _, err := fmt.Fprintf(w, "BROKEN %s (%s)\n", bp.URL, bp.describe()); err != nil {
+			return err
+		}
+		for _, from := range bp.LinkedFrom {
+			if _, err := fmt.Fprintf(w, "    linked from %s\n", from); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := fmt.Fprintf(w, "%d broken pages found\n", len(broken))
+	return err
+}
+
+// describe returns the status code and error of bp as a single string.
+func (bp BrokenPage) describe() string {
+	switch {
+	case bp.Status == 0:
+		return bp.Error
+	case bp.Error == "":
+		return fmt.Sprintf("status %d", bp.Status)
+	}
+	return fmt.Sprintf("status %d: %s", bp.Status, bp.Error)
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+// WriteJUnit writes the results of the crawl to w as a JUnit XML report. Each
+// page is a test case, broken pages are failures and pages which were not
+// crawled are skipped.
+func (sm *SiteMap) WriteJUnit(w io.Writer) error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	broken := map[string]BrokenPage{}
+	for _, bp := range sm.brokenPages() {
+		broken[bp.Path] = bp
+	}
+
+	suite := junitSuite{Name: sm.URL.String(), Failures: len(broken)}
+	for path, p := range sm.pages {
+		tc := junitCase{ClassName: p.url.Host, Name: path, Time: p.duration.Seconds()}
+		if bp, ok := broken[path]; ok {
+			text := ""
+			for _, from := range bp.LinkedFrom {
+				text += fmt.Sprintf("linked from %s\n", from)
+			}
+			tc.Failure = &junitFailure{Message: bp.describe(), Text: text}
+		}
+		if p.skipped != "" {
+			tc.Skipped = &junitSkipped{Message: p.skipped}
+		}
+		suite.Cases = append(suite.Cases, tc)
+	}
+	sort.Slice(suite.Cases, func(i, j int) bool { return suite.Cases[i].Name < suite.Cases[j].Name })
+	suite.Tests = len(suite.Cases)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,90 @@
+package mapper
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestBrokenPages(t *testing.T) {
+	server := newRedirectServer()
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.pages["/gone"] = newPage(sm.URL.ResolveReference(&url.URL{Path: "/gone"}))
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []BrokenPage{
+		{
+			Path:       "/constants",
+			URL:        server.URL + "/constants",
+			Status:     http.StatusNotFound,
+			Error:      "Status code 404",
+			Class:      errorHTTP4xx,
+			LinkedFrom: []string{"/gone", "/variables"},
+		},
+	}
+	got := sm.BrokenPages()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Got broken pages\n%+v\nwant\n%+v", got, want)
+	}
+
+	var report bytes.Buffer
+	if err := WriteBrokenReport(&report, got); err != nil {
+		t.Fatal(err)
+	}
+	wantReport := "BROKEN " + server.URL + "/constants (status 404: Status code 404)\n" +
+		"    linked from /gone\n" +
+		"    linked from /variables\n" +
+		"1 broken pages found\n"
+	if report.String() != wantReport {
+		t.Errorf("Got report\n%s\nwant\n%s", report.String(), wantReport)
+	}
+}
+
+func TestWriteJUnit(t *testing.T) {
+	server := newRedirectServer()
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := sm.WriteJUnit(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(buf.String(), xml.Header) {
+		t.Error("JUnit report is missing the XML header")
+	}
+
+	var suite junitSuite
+	if err := xml.Unmarshal(buf.Bytes(), &suite); err != nil {
+		t.Fatal(err)
+	}
+	if suite.Tests != len(sm.pages) || len(suite.Cases) != len(sm.pages) {
+		t.Errorf("Got %d tests and %d cases, want %d", suite.Tests, len(suite.Cases), len(sm.pages))
+	}
+	if suite.Failures != 1 {
+		t.Errorf("Got %d failures, want 1", suite.Failures)
+	}
+	for _, tc := range suite.Cases {
+		if (tc.Failure != nil) != (tc.Name == "/constants") {
+			t.Errorf("Case %q got failure %+v", tc.Name, tc.Failure)
+		}
+	}
+}
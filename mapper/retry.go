@@ -0,0 +1,150 @@
+package mapper
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultRetries      = 2
+	defaultRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff     = 30 * time.Second
+)
+
+// The classes of error a page can fail with.
+const (
+	errorDNS      = "dns"
+	errorRefused  = "connection_refused"
+	errorReset    = "connection_reset"
+	errorTLS      = "tls"
+	errorTimeout  = "timeout"
+	errorHTTP4xx  = "http_4xx"
+	errorHTTP5xx  = "http_5xx"
+	errorBodyRead = "body_read"
+	errorParse    = "parse"
+	errorOther    = "other"
+)
+
+// readError is an error reading the body of a response.
+type readError struct{ error }
+
+// parseError is an error parsing a URL given in a response.
+type parseError struct{ error }
+
+// classifyError returns the class of the error err from fetching a page, resp
+// being the final response if there was one.
+func classifyError(err error, resp *http.Response) string {
+	switch err.(type) {
+	case readError:
+		return errorBodyRead
+	case parseError:
+		return errorParse
+	}
+	if ue, ok := err.(*url.Error); ok && ue.Op == "parse" {
+		return errorParse
+	}
+	if resp != nil && resp.StatusCode >= 400 && resp.StatusCode <= 499 {
+		return errorHTTP4xx
+	}
+	if resp != nil && resp.StatusCode >= 500 && resp.StatusCode <= 599 {
+		return errorHTTP5xx
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return errorTimeout
+	}
+	for err != nil {
+		switch e := err.(type) {
+		case *net.DNSError:
+			return errorDNS
+		case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, tls.RecordHeaderError:
+			return errorTLS
+		case syscall.Errno:
+			switch e {
+			case syscall.ECONNREFUSED:
+				return errorRefused
+			case syscall.ECONNRESET:
+				return errorReset
+			}
+			return errorOther
+		case *url.Error:
+			err = e.Err
+		case *net.OpError:
+			err = e.Err
+		case *os.SyscallError:
+			err = e.Err
+		default:
+			switch {
+			case err == io.EOF || err == io.ErrUnexpectedEOF:
+				return errorReset // the connection was closed before a response
+			case strings.HasPrefix(err.Error(), "tls: ") || strings.HasPrefix(err.Error(), "x509: "):
+				return errorTLS
+			}
+			return errorOther
+		}
+	}
+	return errorOther
+}
+
+// transient reports if fetching a page may succeed when retried after
+// failing with the error class, resp being the final response if there was
+// one.
+func transient(class string, resp *http.Response) bool {
+	switch class {
+	case errorTimeout, errorReset, errorHTTP5xx, errorBodyRead:
+		return true
+	}
+	return resp != nil && resp.StatusCode == http.StatusTooManyRequests
+}
+
+// visitRetrying visits p, visiting it again up to c.retries times while it
+// fails with a transient error. Each retry waits a jittered exponentially
+// increasing backoff. It returns early if ctx is done while waiting.
+func (c *crawler) visitRetrying(ctx context.Context, p *page) {
+	retries := 0
+	for {
+		c.visit(p)
+		if !p.retry || retries >= c.retries {
+			break
+		}
+		fetchRetries.WithLabelValues(p.errClass).Inc()
+		timer := time.NewTimer(c.retryDelay(retries))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+		retries++
+	}
+	p.retries = retries
+	if p.errClass != "" {
+		fetchErrors.WithLabelValues(p.errClass).Inc()
+	}
+}
+
+// retryDelay returns the wait before retry number n, counting from 0. It is
+// c.retryBackoff doubled for each previous retry, up to maxRetryBackoff, with
+// a random jitter of up to half of it taken off.
+func (c *crawler) retryDelay(n int) time.Duration {
+	delay := c.retryBackoff
+	for i := 0; i < n && delay < maxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryBackoff {
+		delay = maxRetryBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
@@ -0,0 +1,144 @@
+package mapper
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error which timed out.
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyError(t *testing.T) {
+	opError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "http://example.com", Err: &net.OpError{Op: "dial", Net: "tcp", Err: err}}
+	}
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		want   string
+	}{
+		{"dns", opError(&net.DNSError{Err: "no such host", Name: "example.com"}), 0, errorDNS},
+		{"refused", opError(os.NewSyscallError("connect", syscall.ECONNREFUSED)), 0, errorRefused},
+		{"reset", opError(os.NewSyscallError("read", syscall.ECONNRESET)), 0, errorReset},
+		{"eof", &url.Error{Op: "Get", URL: "http://example.com", Err: io.EOF}, 0, errorReset},
+		{"tls", opError(errors.New("tls: handshake failure")), 0, errorTLS},
+		{"timeout", &url.Error{Op: "Get", URL: "http://example.com", Err: timeoutError{}}, 0, errorTimeout},
+		{"4xx", errors.New("Status code 404"), http.StatusNotFound, errorHTTP4xx},
+		{"429", errors.New("Status code 429"), http.StatusTooManyRequests, errorHTTP4xx},
+		{"5xx", errors.New("Status code 502"), http.StatusBadGateway, errorHTTP5xx},
+		{"body", readError{errors.New("unexpected EOF")}, 0, errorBodyRead},
+		{"location", parseError{errors.New("Status code 302 with invalid Location")}, http.StatusFound, errorParse},
+		{"url", &url.Error{Op: "parse", URL: "%", Err: errors.New("invalid URL escape")}, 0, errorParse},
+		{"loop", errors.New("redirect loop back to /"), http.StatusFound, errorOther},
+	}
+	for _, test := range tests {
+		var resp *http.Response
+		if test.status != 0 {
+			resp = &http.Response{StatusCode: test.status}
+		}
+		if got := classifyError(test.err, resp); got != test.want {
+			t.Errorf("%s: got class %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	c := &crawler{retryBackoff: 100 * time.Millisecond}
+	for n, max := range []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 400 * time.Millisecond} {
+		for i := 0; i < 10; i++ {
+			if got := c.retryDelay(n); got < max/2 || got > max {
+				t.Errorf("Retry %d got delay %v, want between %v and %v", n, got, max/2, max)
+			}
+		}
+	}
+	if got := c.retryDelay(20); got > maxRetryBackoff {
+		t.Errorf("Got delay %v, more than the maximum %v", got, maxRetryBackoff)
+	}
+}
+
+func TestStartRetries(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		n := requests[r.URL.Path]
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/":
+			fmt.Fprint(w, `<a href="/flaky">flaky</a><a href="/reset">reset</a><a href="/error">error</a><a href="/missing">missing</a>`)
+		case "/flaky":
+			if n == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+		case "/reset":
+			// close the connection without a response
+			conn, _, err := w.(http.Hijacker).Hijack()
+			if err == nil {
+				conn.Close()
+			}
+		case "/error":
+			w.WriteHeader(http.StatusInternalServerError)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Retries = 2
+	sm.RetryBackoff = time.Millisecond
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+
+	tests := []struct {
+		path    string
+		broken  bool
+		class   string
+		retries int
+	}{
+		{"/flaky", false, "", 1},
+		{"/reset", true, errorReset, 2},
+		{"/error", true, errorHTTP5xx, 2},
+		{"/missing", true, errorHTTP4xx, 0},
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	for _, test := range tests {
+		p := sm.pages[test.path]
+		if p == nil {
+			t.Errorf("Page %q not found", test.path)
+			continue
+		}
+		if p.broken != test.broken || p.errClass != test.class {
+			t.Errorf("Page %q got broken %v class %q, want %v %q", test.path, p.broken, p.errClass, test.broken, test.class)
+		}
+		if p.retries != test.retries {
+			t.Errorf("Page %q got %d retries, want %d", test.path, p.retries, test.retries)
+		}
+		// the transport itself retries a request on a reused connection closed by the server
+		if got, want := requests[test.path], test.retries+1; got < want || (got != want && test.class != errorReset) {
+			t.Errorf("Page %q got %d requests, want %d", test.path, got, want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package mapper
+
+import (
+	"bufio"
+	"encoding/xml"
+	"io"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxSitemapDepth limits how many levels of sitemap index files are followed
+// when collecting seeds from the sitemaps listed in robots.txt.
+const maxSitemapDepth = 2
+
+// robots holds the rules from a site's robots.txt which apply to a single
+// user-agent along with the sitemaps the file lists.
+type robots struct {
+	rules      []robotsRule
+	crawlDelay time.Duration
+	sitemaps   []string
+}
+
+// robotsRule is a single Allow or Disallow line from robots.txt.
+type robotsRule struct {
+	allow   bool
+	pattern string
+}
+
+// robotsGroup is a set of rules which apply to the listed user-agents.
+type robotsGroup struct {
+	agents     []string
+	rules      []robotsRule
+	crawlDelay time.Duration
+}
+
+// parseRobots reads a robots.txt file returning the rules for the given
+// user-agent. The group with the longest user-agent token matching userAgent
+// is used, falling back to the '*' group. Sitemap lines are collected
+// regardless of which group they appear in.
+func parseRobots(r io.Reader, userAgent string) *robots {
+	rbts := &robots{}
+	var groups []*robotsGroup
+	var current *robotsGroup
+	inAgents := false // true while reading consecutive user-agent lines
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		split := strings.SplitN(line, ":", 2)
+		if len(split) != 2 {
+			continue
+		}
+		key := strings.ToLower(strings.TrimSpace(split[0]))
+		value := strings.TrimSpace(split[1])
+
+		switch key {
+		case "user-agent":
+			if !inAgents {
+				current = &robotsGroup{}
+				groups = append(groups, current)
+				inAgents = true
+			}
+			current.agents = append(current.agents, strings.ToLower(value))
+			continue
+		case "sitemap":
+			if value != "" {
+				rbts.sitemaps = append(rbts.sitemaps, value)
+			}
+		case "allow", "disallow":
+			// An empty Disallow allows everything and so adds no rule.
+			if current != nil && value != "" {
+				current.rules = append(current.rules, robotsRule{allow: key == "allow", pattern: value})
+			}
+		case "crawl-delay":
+			if current == nil {
+				break
+			}
+			if seconds, err := strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				current.crawlDelay = time.Duration(seconds * float64(time.Second))
+			}
+		}
+		inAgents = false
+	}
+
+	agent := strings.ToLower(userAgent)
+	if i := strings.Index(agent, "/"); i >= 0 {
+		agent = agent[:i]
+	}
+	// Groups are scored by their longest matching agent token, '*' scores 0.
+	best := -1
+	var matched []*robotsGroup
+	for _, g := range groups {
+		score := -1
+		for _, a := range g.agents {
+			switch {
+			case a == "*" && score < 0:
+				score = 0
+			case a != "*" && strings.Contains(agent, a) && len(a) > score:
+				score = len(a)
+			}
+		}
+		switch {
+		case score < 0 || score < best:
+		case score == best:
+			matched = append(matched, g)
+		default:
+			best = score
+			matched = []*robotsGroup{g}
+		}
+	}
+	for _, g := range matched {
+		rbts.rules = append(rbts.rules, g.rules...)
+		if g.crawlDelay > rbts.crawlDelay {
+			rbts.crawlDelay = g.crawlDelay
+		}
+	}
+
+	return rbts
+}
+
+// allowed reports if the given URL may be crawled. The longest matching rule
+// wins with Allow taking precedence when an Allow and Disallow rule are the
+// same length.
+func (r *robots) allowed(u *url.URL) bool {
+	if r == nil {
+		return true
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	if u.RawQuery != "" {
+		path += "?" + u.RawQuery
+	}
+
+	allow := true
+	longest := -1
+	for _, rule := range r.rules {
+		if !robotsMatch(rule.pattern, path) {
+			continue
+		}
+		if len(rule.pattern) > longest || (len(rule.pattern) == longest && rule.allow) {
+			longest = len(rule.pattern)
+			allow = rule.allow
+		}
+	}
+	return allow
+}
+
+// robotsMatch reports if path matches a robots.txt path pattern. Patterns
+// match as a prefix, '*' matches any sequence of characters and a trailing '$'
+// anchors the pattern to the end of the path.
+func robotsMatch(pattern, path string) bool {
+	anchored := strings.HasSuffix(pattern, "$")
+	if anchored {
+		pattern = strings.TrimSuffix(pattern, "$")
+	}
+	parts := strings.Split(pattern, "*")
+
+	if !strings.HasPrefix(path, parts[0]) {
+		return false
+	}
+	rest := path[len(parts[0]):]
+	for i, part := range parts[1:] {
+		last := i == len(parts)-2
+		if last && anchored {
+			return strings.HasSuffix(rest, part)
+		}
+		j := strings.Index(rest, part)
+		if j < 0 {
+			return false
+		}
+		rest = rest[j+len(part):]
+	}
+	return !anchored || rest == ""
+}
+
+// sitemapXML covers both the urlset and sitemapindex documents defined by
+// sitemaps.org, only the loc elements are needed to seed a crawl.
+type sitemapXML struct {
+	URLs     []sitemapLoc `xml:"url"`
+	Sitemaps []sitemapLoc `xml:"sitemap"`
+}
+
+type sitemapLoc struct {
+	Loc string `xml:"loc"`
+}
+
+// sitemapSeeds retrieves the sitemap at sitemapURL returning the page URLs it
+// lists. Sitemap index files are followed up to maxSitemapDepth levels.
+func (c *crawler) sitemapSeeds(sitemapURL string, depth int) ([]string, error) {
+	resp, _, err := c.get(sitemapURL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var sx sitemapXML
+	if err := xml.NewDecoder(resp.Body).Decode(&sx); err != nil {
+		return nil, err
+	}
+	var seeds []string
+	for _, u := range sx.URLs {
+		seeds = append(seeds, strings.TrimSpace(u.Loc))
+	}
+	if depth >= maxSitemapDepth {
+		return seeds, nil
+	}
+	for _, s := range sx.Sitemaps {
+		more, err := c.sitemapSeeds(strings.TrimSpace(s.Loc), depth+1)
+		if err != nil {
+			return seeds, err
+		}
+		seeds = append(seeds, more...)
+	}
+	return seeds, nil
+}
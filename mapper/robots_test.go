@@ -0,0 +1,163 @@
+package mapper
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRobots = `# test robots.txt
+User-agent: *
+Disallow: /private
+Crawl-delay: 1
+
+User-agent: sitemapper
+User-agent: otherbot
+Disallow: /values
+Allow: /values/public
+Disallow: /*.pdf$
+Crawl-delay: 0.5
+
+User-agent: sitemapper-ng
+Disallow: /
+
+Sitemap: http://testhost.com/sitemap.xml
+`
+
+func TestParseRobots(t *testing.T) {
+	tests := []struct {
+		name       string
+		userAgent  string
+		wantRules  []robotsRule
+		wantDelay  time.Duration
+		wantGroups int
+	}{
+		{
+			name:      "specific agent",
+			userAgent: "sitemapper/1.0",
+			wantRules: []robotsRule{
+				{pattern: "/values"},
+				{allow: true, pattern: "/values/public"},
+				{pattern: "/*.pdf$"},
+			},
+			wantDelay: 500 * time.Millisecond,
+		},
+		{
+			name:      "longest agent match",
+			userAgent: "Sitemapper-NG",
+			wantRules: []robotsRule{{pattern: "/"}},
+		},
+		{
+			name:      "default group",
+			userAgent: "unknown",
+			wantRules: []robotsRule{{pattern: "/private"}},
+			wantDelay: time.Second,
+		},
+	}
+
+	for _, test := range tests {
+		r := parseRobots(strings.NewReader(testRobots), test.userAgent)
+		if !reflect.DeepEqual(r.rules, test.wantRules) {
+			t.Errorf("Test %q - got rules %+v, want %+v", test.name, r.rules, test.wantRules)
+		}
+		if r.crawlDelay != test.wantDelay {
+			t.Errorf("Test %q - got crawl delay %v, want %v", test.name, r.crawlDelay, test.wantDelay)
+		}
+		if want := []string{"http://testhost.com/sitemap.xml"}; !reflect.DeepEqual(r.sitemaps, want) {
+			t.Errorf("Test %q - got sitemaps %v, want %v", test.name, r.sitemaps, want)
+		}
+	}
+}
+
+func TestRobotsAllowed(t *testing.T) {
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: "/", want: true},
+		{path: "/values", want: false},
+		{path: "/values/other", want: false},
+		{path: "/values/public", want: true},
+		{path: "/private", want: true},
+		{path: "/docs/file.pdf", want: false},
+		{path: "/docs/file.pdf?download=1", want: true},
+	}
+
+	r := parseRobots(strings.NewReader(testRobots), "sitemapper")
+	for _, test := range tests {
+		u, err := url.Parse("http://testhost.com" + test.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := r.allowed(u); got != test.want {
+			t.Errorf("Test %q - got allowed %t, want %t", test.path, got, test.want)
+		}
+	}
+
+	var none *robots
+	if !none.allowed(testPageURL) {
+		t.Error("A nil robots should allow all pages")
+	}
+}
+
+func TestRobotsMatch(t *testing.T) {
+	tests := []struct {
+		pattern string
+		path    string
+		want    bool
+	}{
+		{pattern: "/", path: "/anything", want: true},
+		{pattern: "/fish", path: "/fish.html", want: true},
+		{pattern: "/fish", path: "/Fish", want: false},
+		{pattern: "/fish/", path: "/fish", want: false},
+		{pattern: "/*.php", path: "/folder/index.php?x=1", want: true},
+		{pattern: "/*.php$", path: "/index.php", want: true},
+		{pattern: "/*.php$", path: "/index.php5", want: false},
+		{pattern: "/fish*$", path: "/fish/salmon", want: true},
+		{pattern: "/a*b*c", path: "/a-c-b", want: false},
+		{pattern: "/exact$", path: "/exact", want: true},
+		{pattern: "/exact$", path: "/exactly", want: false},
+	}
+
+	for _, test := range tests {
+		if got := robotsMatch(test.pattern, test.path); got != test.want {
+			t.Errorf("Pattern %q path %q - got %t, want %t", test.pattern, test.path, got, test.want)
+		}
+	}
+}
+
+func TestSitemapSeeds(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.HandleFunc("/sitemap-index.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<sitemapindex xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <sitemap><loc>%s/sitemap.xml</loc></sitemap>
+</sitemapindex>`, server.URL)
+	})
+	mux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9">
+  <url><loc>%s/page1</loc></url>
+  <url><loc> %s/page2 </loc></url>
+</urlset>`, server.URL, server.URL)
+	})
+
+	c := newCrawler()
+	seeds, err := c.sitemapSeeds(server.URL+"/sitemap-index.xml", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(seeds)
+	if want := []string{server.URL + "/page1", server.URL + "/page2"}; !reflect.DeepEqual(seeds, want) {
+		t.Errorf("Got seeds %v, want %v", seeds, want)
+	}
+}
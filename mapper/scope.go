@@ -0,0 +1,83 @@
+package mapper
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// skipScope is the skipped reason for pages outside the scope of the crawl.
+const skipScope = "out of scope"
+
+// ParsePattern returns a regular expression matching the site relative paths,
+// including any query kept, described by pattern. A pattern beginning "re:"
+// is a regular expression, otherwise it is a glob anchored at both ends where
+// "*" matches any characters other than "/", "**" any characters and "?" a
+// single character.
+func ParsePattern(pattern string) (*regexp.Regexp, error) {
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+		return re, nil
+	}
+	var expr bytes.Buffer
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString(".")
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// inScope reports if the page p should be crawled
+// according to sm.Include, sm.Exclude and sm.StayUnderStart. The patterns
+// match the path of pages on every site, StayUnderStart uses the starting
+// page of the site p is on. The starting pages are always in scope. The
+// caller must hold sm.mu.
+func (sm *SiteMap) inScope(p *page) bool {
+	start := sm.siteStart(p)
+	if p == start {
+		return true
+	}
+	key := sm.Normalization.key(p.url)
+	if sm.StayUnderStart {
+		dir := start.url.Path
+		if !strings.HasSuffix(dir, "/") {
+			dir = path.Dir(dir)
+			if !strings.HasSuffix(dir, "/") {
+				dir += "/"
+			}
+		}
+		if !strings.HasPrefix(key, dir) && key != strings.TrimSuffix(dir, "/") {
+			return false
+		}
+	}
+	for _, re := range sm.Exclude {
+		if re.MatchString(key) {
+			return false
+		}
+	}
+	if len(sm.Include) == 0 {
+		return true
+	}
+	for _, re := range sm.Include {
+		if re.MatchString(key) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,107 @@
+package mapper
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+)
+
+func TestParsePattern(t *testing.T) {
+	tests := []struct {
+		pattern string
+		matches map[string]bool
+	}{
+		{
+			pattern: "/blog/*",
+			matches: map[string]bool{"/blog/post": true, "/blog/2018/post": false, "/blog": false},
+		},
+		{
+			pattern: "/blog/**",
+			matches: map[string]bool{"/blog/post": true, "/blog/2018/post": true, "/docs/blog/post": false},
+		},
+		{
+			pattern: "/page?.html",
+			matches: map[string]bool{"/page1.html": true, "/page12.html": false, "/pageX.html": true},
+		},
+		{
+			pattern: "re:^/(docs|api)/",
+			matches: map[string]bool{"/docs/intro": true, "/api/v1": true, "/blog/docs/": false},
+		},
+		{
+			pattern: "**?print=*",
+			matches: map[string]bool{"/a?print=1": true, "/a": false},
+		},
+	}
+	for _, test := range tests {
+		re, err := ParsePattern(test.pattern)
+		if err != nil {
+			t.Fatalf("Pattern %q: %v", test.pattern, err)
+		}
+		for path, want := range test.matches {
+			if got := re.MatchString(path); got != want {
+				t.Errorf("Pattern %q path %q - got %t, want %t", test.pattern, path, got, want)
+			}
+		}
+	}
+	if _, err := ParsePattern("re:("); err == nil {
+		t.Error("Got nil error for an invalid regular expression")
+	}
+}
+
+func TestStartScope(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/docs/intro">intro</a><a href="/docs/private/key">private</a><a href="/blog/post">blog</a><a href="/docs">docs</a>`))
+	}))
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/docs/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.IgnoreRobots = true
+	sm.StayUnderStart = true
+	sm.Exclude = []*regexp.Regexp{regexp.MustCompile("^/docs/private/")}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"/docs/":            "",
+		"/docs/intro":       "",
+		"/docs":             "",
+		"/docs/private/key": skipScope,
+		"/blog/post":        skipScope,
+	}
+	if len(sm.pages) != len(want) {
+		t.Errorf("Got %d pages, want %d", len(sm.pages), len(want))
+	}
+	for path, p := range sm.pages {
+		wantSkipped, ok := want[path]
+		if !ok {
+			t.Errorf("Got unwanted path %q", path)
+			continue
+		}
+		if p.skipped != wantSkipped || p.visited == (wantSkipped != "") {
+			t.Errorf("Path %q got skipped %q visited %t", path, p.skipped, p.visited)
+		}
+	}
+
+	sm, err = NewSiteMap(server.URL+"/docs/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.IgnoreRobots = true
+	sm.Include = []*regexp.Regexp{regexp.MustCompile("^/blog/")}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if p := sm.pages["/blog/post"]; !p.visited {
+		t.Error("Included page /blog/post was not visited")
+	}
+	if p := sm.pages["/docs/intro"]; p.skipped != skipScope {
+		t.Errorf("Page /docs/intro not included got skipped %q", p.skipped)
+	}
+}
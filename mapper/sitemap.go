@@ -3,13 +3,15 @@
 package mapper
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"log"
+	"net/http"
 	"net/url"
-	"os"
-	"os/signal"
-	"syscall"
+	"regexp"
+	"sync"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -23,116 +25,673 @@ var (
 		Name: "pages_visited",
 		Help: "The number of pages for which an HTTP GET has been attempted.",
 	})
+	fetchDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "page_fetch_duration_seconds",
+		Help:    "The wall clock time taken to fetch and read each page.",
+		Buckets: prometheus.ExponentialBuckets(0.01, 2, 12),
+	})
+	responseSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Name:    "page_size_bytes",
+		Help:    "The size of the successfully retrieved page bodies.",
+		Buckets: prometheus.ExponentialBuckets(1024, 4, 10),
+	})
+	externalChecks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "external_links_checked",
+		Help: "The number of links to other sites checked.",
+	})
+	fetchErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fetch_errors",
+		Help: "The number of pages which failed after any retries, by the class of error.",
+	}, []string{"class"})
+	fetchRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "fetch_retries",
+		Help: "The number of times pages were retried after a transient error, by the class of error.",
+	}, []string{"class"})
+	throttledSeconds = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "throttled_seconds",
+		Help: "Time spent waiting before requests to stay within the politeness limits, by reason.",
+	}, []string{"reason"})
+	crawlState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "crawl_state",
+		Help: "1 for the current state of the crawl, new, crawling, paused, stopped or finished, otherwise 0.",
+	}, []string{"state"})
 )
 
 func init() {
 	prometheus.MustRegister(pageCount)
 	prometheus.MustRegister(pagesVisited)
+	prometheus.MustRegister(fetchDuration)
+	prometheus.MustRegister(responseSize)
+	prometheus.MustRegister(externalChecks)
+	prometheus.MustRegister(fetchErrors)
+	prometheus.MustRegister(fetchRetries)
+	prometheus.MustRegister(throttledSeconds)
+	prometheus.MustRegister(crawlState)
 }
 
+// defaultUserAgent is the user-agent sent with requests and used to select
+// robots.txt rules unless SiteMap.UserAgent is changed.
+const defaultUserAgent = "sitemapper"
+
+// The states of a SiteMap crawl.
+const (
+	stateNew      = "new"
+	stateCrawling = "crawling"
+	statePaused   = "paused"
+	stateFinished = "finished"
+	stateStopped  = "stopped"
+)
+
 // SiteMap is the data structure in which a mapping of a website is built.
+// It is safe to read from, for example with ServeHTTP, while Start is running.
 type SiteMap struct {
-	pages       map[string]*page // p.URL.Path for the string
-	URL         *url.URL
-	shutdown    chan os.Signal
+	mu    sync.RWMutex     // guards pages, the fields of each page, robots and state
+	pages map[string]*page // p.URL.Path for the string
+	URL   *url.URL
+	// UserAgent is sent with each request and selects which robots.txt rules
+	// apply to the crawl.
+	UserAgent string
+	// IgnoreRobots disables retrieving and honoring the site's robots.txt.
+	IgnoreRobots bool
+	// SeedFromSitemaps adds the pages listed in the sitemaps named in
+	// robots.txt to the crawl along with the starting page.
+	SeedFromSitemaps bool
+	// MaxRedirects is the number of redirects followed for a page before it
+	// is considered broken.
+	MaxRedirects int
+	// CheckpointFile, if set, is where the crawl state is saved every
+	// CheckpointInterval as well as when crawling stops or finishes. The
+	// crawl can be resumed from the file with LoadSiteMapFile.
+	CheckpointFile     string
+	CheckpointInterval time.Duration
+	// Normalization configures how link URLs are normalized into the paths
+	// pages are keyed by.
+	Normalization Normalizer
+	// Include and Exclude limit the crawl to the pages whose paths match an
+	// Include pattern, if there are any, and no Exclude pattern, see
+	// ParsePattern. StayUnderStart limits it to pages under the directory of
+	// the starting page. Pages out of scope are kept as unvisited leaf pages.
+	Include        []*regexp.Regexp
+	Exclude        []*regexp.Regexp
+	StayUnderStart bool
+	// Subdomains includes the pages on any host sharing a registrable domain
+	// with one of the sites, ie docs.example.com for example.com, keyed by
+	// "//" followed by their host and path.
+	Subdomains bool
+	// HostAliases maps alias hosts to the host of a site they are merged
+	// into, links to an alias being followed as links to that host.
+	HostAliases map[string]string
+	// ReportSchemeMismatch notes links to the sites using a different scheme
+	// than their page as a finding. Pages are keyed without their scheme so
+	// the http and https URLs of a page are always the same page.
+	ReportSchemeMismatch bool
+	// Fetcher, if set, retrieves the pages of the crawl rather than the
+	// network, ie a DirFetcher or WARCFetcher. Otherwise Transport makes the
+	// requests of the crawl if set, or a transport is created for each crawl
+	// from TransportOptions. Links to other sites are still checked over the
+	// network with Transport or TransportOptions when Fetcher is set. Each
+	// request times out after RequestTimeout, zero for no timeout.
+	Fetcher          Fetcher
+	Transport        http.RoundTripper
+	TransportOptions TransportOptions
+	RequestTimeout   time.Duration
+	// WARCPrefix, if set, records each request and response of the crawl to
+	// WARC 1.1 files named WARCPrefix-timestamp-serial.warc.gz, gzipped per
+	// record. A new file is started once one reaches WARCMaxSize bytes, zero
+	// for no limit.
+	WARCPrefix  string
+	WARCMaxSize int64
+	// Header is sent with each request to the crawled sites along with the
+	// basic auth Username and Password or, taking precedence, BearerToken if
+	// set. They are never sent to other sites.
+	Header      http.Header
+	Username    string
+	Password    string
+	BearerToken string
+	// CookieFile is a Netscape format cookies file, as written by curl, whose
+	// cookies are sent with the requests of the crawl. If Login is set its
+	// form is posted before crawling begins and the session cookies it sets
+	// are also sent.
+	CookieFile string
+	Login      *Login
+	// Retries is the number of times a page failing with a transient error,
+	// a timeout, connection reset, error reading the body, 5xx or 429
+	// response, is retried. The first retry waits about RetryBackoff, which
+	// doubles for each one after with a random jitter.
+	Retries      int
+	RetryBackoff time.Duration
+	// HostRate limits the requests to each host to that many per second and
+	// HostConnections the number of requests to each host in progress at
+	// once, zero for no limit. Regardless of them the requests to a host back
+	// off when it responds 429 Too Many Requests or 503 Service Unavailable,
+	// for its Retry-After if given.
+	HostRate        float64
+	HostConnections int
+	// CheckExternal records the links to other sites on each page and checks
+	// each URL once, following redirects, without crawling it further. The
+	// checks are made by ExternalWorkers go routines separate from the
+	// crawling workers, waiting at least ExternalInterval between requests
+	// to the same host.
+	CheckExternal    bool
+	ExternalWorkers  int
+	ExternalInterval time.Duration
+	// MaxDepth and MaxPages limit the crawl to pages within that many clicks
+	// of the starting page and to that many pages visited. Timeout limits
+	// the time the crawl runs for. They are unlimited when 0, a crawl
+	// reaching a limit finishes early with the reason given by Truncated.
+	MaxDepth int
+	MaxPages int
+	Timeout  time.Duration
+	// RespectNofollow skips links marked rel=nofollow and all links on pages
+	// with a robots meta tag containing nofollow.
+	RespectNofollow bool
+	// Baseline is a previous crawl of the site. When set, pages it retrieved
+	// successfully are requested conditionally and the baseline links reused
+	// for those not modified. Only pages reachable in the new crawl are kept,
+	// RecrawlSummary reports the differences from the baseline.
+	Baseline    *SiteMap
+	external    map[string]*externalLink // the links to other sites by URL
+	others      []string                 // the keys of the starting pages of the sites added with AddSite
+	pauser      pauser
+	robots      map[string]*robots // the robots.txt rules of each site by host
+	start       string             // the path of the starting page
+	state       string
+	truncated   string // the reason the crawl was cut short by a limit
 	workerCount uint
 }
 
 // NewSiteMap returns a SiteMap initialized with the starting URL, path and the
-// number of workers used when crawling the site. It also sets up signal
-// handling which stops crawling for SIGTERM or SIGINT.
+// number of workers used when crawling the site. More sites can be crawled
+// along with it using AddSite.
 func NewSiteMap(startPage string, workerCount uint) (*SiteMap, error) {
 	if workerCount < 1 {
 		return nil, errors.New("workerCount for a SiteMap must be > 0")
 	}
-	start, err := url.Parse(startPage)
+	start, err := parseStart(startPage)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse page %q: %v", startPage, err)
-	}
-
-	if start.Scheme == "" {
-		log.Printf("No URL scheme specified using 'http'")
-		start, err = url.Parse("http://" + startPage)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse page %q: %v", "http://"+startPage, err)
-		}
+		return nil, err
 	}
 	siteURL := &url.URL{
 		Scheme: start.Scheme,
 		Host:   start.Host,
 	}
-	if start.Path == "" {
-		start.Path = "/"
-	}
 	sm := &SiteMap{
-		pages:       map[string]*page{start.Path: newPage(start)},
-		URL:         siteURL,
-		workerCount: workerCount,
+		pages:            map[string]*page{start.Path: newPage(start)},
+		URL:              siteURL,
+		UserAgent:        defaultUserAgent,
+		MaxRedirects:     defaultMaxRedirects,
+		RequestTimeout:   clientTimeout,
+		WARCMaxSize:      defaultWARCMaxSize,
+		Retries:          defaultRetries,
+		RetryBackoff:     defaultRetryBackoff,
+		ExternalWorkers:  defaultExternalWorkers,
+		ExternalInterval: defaultExternalInterval,
+		external:         map[string]*externalLink{},
+		start:            start.Path,
+		state:            stateNew,
+		workerCount:      workerCount,
 	}
-
-	sm.shutdown = make(chan os.Signal, 2)
-	signal.Notify(sm.shutdown, syscall.SIGINT, syscall.SIGTERM)
 	return sm, nil
 }
 
 // Start begins crawling a website with the starting URL using the assigned
-// number of workers, exiting when the process is completed or when a signal
-// is received on the SiteMap shutdown channel.
-func (sm *SiteMap) Start() error {
+// number of workers, returning when the process is completed or when ctx is
+// done. Unless IgnoreRobots is set each site's robots.txt is retrieved first
+// and pages it disallows are not crawled.
+//
+// The crawlers each visit a copy of a page, Start is the only writer to the
+// pages in sm updating them from the copies as they finish. The crawlers
+// have returned and their requests are cancelled when Start returns, pages
+// still being visited when ctx is done are left unvisited and ctx.Err() is
+// returned.
+func (sm *SiteMap) Start(ctx context.Context) error {
 	// TODO setup performance tests to determine the best buffer sizes
 	new := make(chan *page, sm.workerCount*2)
 	visited := make(chan *page, sm.workerCount*2)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
+	sm.pauser.resume()
+	sm.setState(stateCrawling)
 	c := newCrawler()
+	rt, external, closeTransport, err := sm.transport()
+	if err != nil {
+		sm.setState(stateStopped)
+		return err
+	}
+	defer closeTransport()
+	c.setTransport(rt, external, sm.RequestTimeout)
+	if sm.WARCPrefix != "" {
+		c.warc = newWARCWriter(sm.WARCPrefix, sm.WARCMaxSize, sm.Header)
+		defer func() {
+			if err := c.warc.Close(); err != nil {
+				log.Printf("Failed to close WARC file: %v", err)
+			}
+		}()
+	}
+	c.ctx = ctx
+	c.pauser = &sm.pauser
+	c.userAgent = sm.UserAgent
+	c.maxRedirects = sm.MaxRedirects
+	c.nofollow = sm.RespectNofollow
+	c.normalizer = &sm.Normalization
+	c.baseline = sm.baselinePages()
+	c.external = sm.CheckExternal
+	c.retries = sm.Retries
+	c.retryBackoff = sm.RetryBackoff
+	c.limiter = &hostLimiter{connections: sm.HostConnections}
+	if sm.HostRate > 0 {
+		c.limiter.interval = time.Duration(float64(time.Second) / sm.HostRate)
+	}
+	c.externalThrottle = &hostThrottle{interval: sm.ExternalInterval}
+	sm.mu.Lock()
+	sm.robots = nil
+	sm.truncated = ""
+	sm.normalizeStart()
+	c.sites = sm.hosts()
+	c.schemes = sm.ReportSchemeMismatch
+	sm.mu.Unlock()
+	if err := sm.session(c); err != nil {
+		sm.setState(stateStopped)
+		return err
+	}
+	if !sm.IgnoreRobots {
+		sm.loadRobots(c)
+	}
 	for i := uint(0); i < sm.workerCount; i++ {
 		c.crawl(new, visited)
 	}
+	unchecked := make(chan *externalLink, sm.ExternalWorkers)
+	checked := make(chan *externalLink, sm.ExternalWorkers)
+	if sm.CheckExternal {
+		workers := sm.ExternalWorkers
+		if workers < 1 {
+			workers = 1
+		}
+		c.checkExternal(unchecked, checked, workers)
+	}
+
+	var checkpoints <-chan time.Time
+	if sm.CheckpointFile != "" && sm.CheckpointInterval > 0 {
+		ticker := time.NewTicker(sm.CheckpointInterval)
+		defer ticker.Stop()
+		checkpoints = ticker.C
+	}
+	var deadline <-chan time.Time
+	if sm.Timeout > 0 {
+		timer := time.NewTimer(sm.Timeout)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	// queue sends copies of the pages in scope, within the limits and allowed
+	// by robots.txt to the crawlers, the others are marked as skipped and
+	// remain unvisited. Pages on a host whose robots.txt is not yet known,
+	// such as a subdomain, are held until it is retrieved.
+	inflight := map[*page]*page{}         // the copy being visited to the page in sm
+	held := map[string][]*page{}          // the pages waiting for the robots.txt of their host
+	robotsLoaded := make(chan hostRobots) // the robots.txt retrieved for the held hosts
+	queued := 0                           // pages visited or queued to be, for MaxPages
+	queue := func(pages []*page) {
+		var toVisit []*page
+		fetch := map[string]*url.URL{} // the sites to retrieve robots.txt from by host
+		sm.mu.Lock()
+		for _, p := range pages {
+			if !sm.inScope(p) {
+				p.skipped = skipScope
+				continue
+			}
+			if reason := sm.limitReason(p, queued); reason != "" {
+				p.skipped = reason
+				continue
+			}
+			host := sm.Normalization.host(p.url)
+			if _, ok := sm.robots[host]; !ok && !sm.IgnoreRobots {
+				if _, ok := held[host]; !ok {
+					fetch[host] = &url.URL{Scheme: p.url.Scheme, Host: p.url.Host, Path: "/"}
+				}
+				held[host] = append(held[host], p)
+				continue
+			}
+			if !sm.robots[host].allowed(p.url) {
+				p.skipped = skipRobots
+				continue
+			}
+			v := p.clone()
+			inflight[v] = p
+			toVisit = append(toVisit, v)
+			queued++
+		}
+		sm.mu.Unlock()
+		for host, site := range fetch {
+			go func(host string, site *url.URL) {
+				select {
+				case robotsLoaded <- hostRobots{host: host, robots: sm.fetchRobots(c, site)}:
+				case <-ctx.Done():
+				}
+			}(host, site)
+		}
+		go func() { // add to new without blocking processing of visited
+			for _, p := range toVisit {
+				select {
+				case new <- p:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
 
+	// check sends the links to other sites from p not yet checked to the
+	// external link checkers.
+	checking := map[string]bool{} // the URLs of the links being checked
+	check := func(p *page) {
+		if !sm.CheckExternal {
+			return
+		}
+		sm.mu.Lock()
+		toCheck := sm.uncheckedExternal(p, checking)
+		sm.mu.Unlock()
+		go func() {
+			for _, l := range toCheck {
+				select {
+				case unchecked <- l:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	var unvisited []*page
 	for _, p := range sm.pages {
 		if !p.visited {
-			new <- p
+			unvisited = append(unvisited, p)
+		} else {
+			queued++
+			check(p)
 		}
 	}
-	var visitCount int
-	for {
+	queue(unvisited)
+	for len(inflight) > 0 || len(checking) > 0 || len(held) > 0 {
 		pageCount.Set(float64(len(sm.pages)))
-		if visitCount < len(sm.pages) {
-			select {
-			case p := <-visited:
-				visitCount++
-				pagesVisited.Inc()
-				toVisit := sm.addPages(p.links)
-				go func() { // add to new without blocking processing of visited
-					for _, p := range toVisit {
-						new <- p
-					}
-				}()
-			case sig := <-sm.shutdown:
-				c.stop()
-				return fmt.Errorf("received shutdown signal %s", sig)
-			}
-		} else if visitCount == len(sm.pages) {
-			return nil
+		select {
+		case v := <-visited:
+			p := inflight[v]
+			delete(inflight, v)
+			pagesVisited.Inc()
+			// a resource linked to as a page while it was checked is crawled
+			// again, p is left unvisited until then
+			if v.resource && !p.resource {
+				queue([]*page{p})
+				continue
+			}
+			// the linked pages are added along with p so the targets of its
+			// links are always pages in sm
+			sm.mu.Lock()
+			depth := p.depth // may have been lowered while p was visited
+			*p = *v
+			p.depth = depth
+			linked := sm.linkPages(p.links, p.resourceLinks(), p.depth+1)
+			if p.redirect != "" {
+				linked = append(linked, sm.linkPages(map[string]int{p.redirect: 1}, map[string]bool{p.redirect: p.resource}, p.depth+1)...)
+			}
+			sm.mu.Unlock()
+			check(p)
+			queue(linked)
+		case r := <-robotsLoaded:
+			sm.mu.Lock()
+			sm.robots[r.host] = r.robots
+			sm.mu.Unlock()
+			pages := held[r.host]
+			delete(held, r.host)
+			queue(pages)
+		case l := <-checked:
+			delete(checking, l.url)
+			sm.mu.Lock()
+			sm.external[l.url] = l
+			sm.mu.Unlock()
+		case <-checkpoints:
+			sm.checkpoint()
+		case <-deadline:
+			// the pages being visited are left unvisited to be resumed
+			sm.mu.Lock()
+			sm.truncate(fmt.Sprintf("timeout of %v reached", sm.Timeout))
+			sm.mu.Unlock()
+			inflight = map[*page]*page{}
+			checking = map[string]bool{}
+			held = map[string][]*page{}
+		case <-ctx.Done():
+			cancel()
+			c.wait()
+			sm.setState(stateStopped)
+			sm.checkpoint()
+			return ctx.Err()
 		}
 	}
+	pageCount.Set(float64(len(sm.pages)))
+	cancel()
+	c.wait()
+	sm.setState(stateFinished)
+	sm.checkpoint()
+	return nil
+}
+
+// normalizeStart keys the unvisited starting pages by their paths normalized
+// with sm.Normalization, which is set after NewSiteMap and AddSite key them.
+// The caller must hold sm.mu.
+func (sm *SiteMap) normalizeStart() {
+	hosts := sm.hosts()
+	rekey := func(start string) string {
+		p := sm.pages[start]
+		key, _ := hosts.key(p.url, &sm.Normalization)
+		if _, ok := sm.pages[key]; ok || p.visited {
+			return start
+		}
+		delete(sm.pages, start)
+		sm.pages[key] = p
+		return key
+	}
+	sm.start = rekey(sm.start)
+	for i, start := range sm.others {
+		sm.others[i] = rekey(start)
+	}
+}
+
+// checkpoint saves the crawl state to sm.CheckpointFile if it is set.
+func (sm *SiteMap) checkpoint() {
+	if sm.CheckpointFile == "" {
+		return
+	}
+	if err := sm.SaveFile(sm.CheckpointFile); err != nil {
+		log.Printf("Failed to save checkpoint %s: %v", sm.CheckpointFile, err)
+	}
+}
+
+// setState records the current state of the crawl.
+func (sm *SiteMap) setState(state string) {
+	sm.mu.Lock()
+	sm.updateState(state)
+	sm.mu.Unlock()
+}
+
+// updateState implements setState, the caller must hold sm.mu.
+func (sm *SiteMap) updateState(state string) {
+	for _, s := range []string{stateNew, stateCrawling, statePaused, stateStopped, stateFinished} {
+		crawlState.WithLabelValues(s).Set(0)
+	}
+	crawlState.WithLabelValues(state).Set(1)
+	sm.state = state
+}
+
+// RobotsSitemaps returns the sitemap URLs listed in the robots.txt of each
+// site. They are available once Start has retrieved robots.txt.
+func (sm *SiteMap) RobotsSitemaps() []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var sitemaps []string
+	for _, host := range sm.hosts().hosts {
+		if rbts := sm.robots[host]; rbts != nil {
+			sitemaps = append(sitemaps, rbts.sitemaps...)
+		}
+	}
+	return sitemaps
+}
+
+// hostRobots is the robots.txt retrieved for a host, nil if there is none.
+type hostRobots struct {
+	host   string
+	robots *robots
+}
+
+// loadRobots retrieves the robots.txt of each site and applies its
+// Crawl-delay to the requests to the site's host. A missing robots.txt places
+// no restrictions on the crawl of its site, an unreachable one blocks it. When
+// SeedFromSitemaps is set the pages listed by the robots.txt sitemaps are
+// added to sm. The robots.txt of other hosts, such as subdomains, is
+// retrieved as their pages are found.
+func (sm *SiteMap) loadRobots(c *crawler) {
+	sm.mu.Lock()
+	var sites []*url.URL
+	for _, key := range sm.startKeys() {
+		start := sm.pages[key].url
+		sites = append(sites, &url.URL{Scheme: start.Scheme, Host: start.Host, Path: "/"})
+	}
+	sm.robots = map[string]*robots{}
+	sm.mu.Unlock()
+
+	for _, site := range sites {
+		rbts := sm.fetchRobots(c, site)
+		sm.mu.Lock()
+		sm.robots[sm.Normalization.host(site)] = rbts
+		sm.mu.Unlock()
+		if rbts == nil || !sm.SeedFromSitemaps {
+			continue
+		}
+		// The site root page is used only to filter the seeds to the sites.
+		root := newPage(site)
+		for _, sitemapURL := range rbts.sitemaps {
+			seeds, err := c.sitemapSeeds(sitemapURL, 0)
+			if err != nil {
+				log.Printf("Failed to read seeds from sitemap %s: %v", sitemapURL, err)
+			}
+			root.addLinks(seeds, c.normalizer, c.sites)
+		}
+		sm.addPages(root.links)
+	}
+}
+
+// fetchRobots retrieves the robots.txt of site and applies its Crawl-delay to
+// the requests to the site's host. It returns nil, placing no restrictions on
+// the site, if the robots.txt is missing or otherwise unavailable with a 4XX
+// status. If the site is unreachable, with a 5XX status or a network error,
+// the whole site is disallowed as RFC 9309 requires.
+func (sm *SiteMap) fetchRobots(c *crawler, site *url.URL) *robots {
+	robotsURL := site.ResolveReference(&url.URL{Path: "/robots.txt"})
+	resp, _, err := c.get(robotsURL.String())
+	if err != nil {
+		switch classifyError(err, resp) {
+		case errorHTTP5xx, errorDNS, errorRefused, errorReset, errorTimeout, errorTLS:
+			log.Printf("Not crawling %s, retrieving %s failed: %v", site, robotsURL, err)
+			return &robots{rules: []robotsRule{{pattern: "/"}}}
+		}
+		if resp == nil || resp.StatusCode != http.StatusNotFound {
+			log.Printf("Crawling without robots.txt restrictions, retrieving %s failed: %v", robotsURL, err)
+		}
+		return nil
+	}
+	rbts := parseRobots(resp.Body, sm.UserAgent)
+	resp.Body.Close()
+	c.limiter.setCrawlDelay(site.Host, rbts.crawlDelay)
+	return rbts
 }
 
 // addPages walks through the given site relative paths adding new pages for
 // each path not already part of sm.Pages and returning those added as a list.
+// The pages are added with a depth of 0, as if linked from outside the site.
 func (sm *SiteMap) addPages(links map[string]int) []*page {
+	return sm.addLinkedPages(links, nil, 0)
+}
+
+// addLinkedPages adds pages as addPages does at the given click depth,
+// marking those set in resources as resources. A resource linked to from a
+// page as a navigation link becomes a page, when it was already visited it
+// is also returned so it is crawled again. Likewise a page skipped for being
+// beyond sm.MaxDepth is returned to be queued again if depth is lower.
+func (sm *SiteMap) addLinkedPages(links map[string]int, resources map[string]bool, depth int) []*page {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.linkPages(links, resources, depth)
+}
+
+// linkPages implements addLinkedPages, the caller must hold sm.mu.
+func (sm *SiteMap) linkPages(links map[string]int, resources map[string]bool, depth int) []*page {
 	var pages []*page
 	for path := range links {
-		if _, ok := sm.pages[path]; !ok {
-			u, err := url.Parse(path)
-			if err != nil {
-				log.Printf("failed to parse relative path %q from page link, all these paths should be prevetted", path)
-				continue
+		if p, ok := sm.pages[path]; ok {
+			requeue := false
+			if depth < p.depth {
+				p.depth = depth
+				requeue = p.skipped == skipDepth
+			}
+			if p.resource && !resources[path] {
+				p.resource = false
+				if p.visited {
+					p.visited = false
+					requeue = true
+				}
+			}
+			if requeue {
+				pages = append(pages, p)
 			}
-			p := newPage(sm.URL.ResolveReference(u))
-			sm.pages[path] = p
-			pages = append(pages, p)
+			continue
 		}
+		u, err := sm.pageURL(path)
+		if err != nil {
+			log.Printf("failed to parse relative path %q from page link, all these paths should be prevetted", path)
+			continue
+		}
+		p := newPage(u)
+		p.depth = depth
+		p.resource = resources[path]
+		sm.pages[path] = p
+		pages = append(pages, p)
 	}
 
 	return pages
 }
+
+// depths returns the click depth of each page reachable from the starting
+// pages by following links and redirects. The starting pages have depth 0.
+// The caller must hold sm.mu.
+func (sm *SiteMap) depths() map[string]int {
+	depths := map[string]int{}
+	next := sm.startKeys()
+	for _, start := range next {
+		depths[start] = 0
+	}
+	for depth := 1; len(next) > 0; depth++ {
+		var current []string
+		current, next = next, nil
+		for _, path := range current {
+			p, ok := sm.pages[path]
+			if !ok {
+				continue
+			}
+			targets := make([]string, 0, len(p.links)+1)
+			for link := range p.links {
+				targets = append(targets, link)
+			}
+			if p.redirect != "" {
+				targets = append(targets, p.redirect)
+			}
+			for _, target := range targets {
+				if _, seen := depths[target]; !seen {
+					depths[target] = depth
+					next = append(next, target)
+				}
+			}
+		}
+	}
+	return depths
+}
@@ -1,12 +1,13 @@
 package mapper
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
-	"os"
 	"reflect"
-	"syscall"
 	"testing"
 	"time"
 )
@@ -139,21 +140,67 @@ func TestAddPages(t *testing.T) {
 	}
 }
 
-func TestHandleSignals(t *testing.T) {
-	sm, err := NewSiteMap("http://localhost", 2)
+func TestAddLinkedPages(t *testing.T) {
+	sm, err := NewSiteMap("http://testsite.com", 2)
 	if err != nil {
 		t.Fatal(err)
 	}
-	pid := os.Getpid()
-	for _, sig := range []syscall.Signal{syscall.SIGINT, syscall.SIGTERM} {
-		if err := syscall.Kill(pid, sig); err != nil {
-			t.Fatalf("syscall Kill signal %s failed: %v", sig, err)
-		}
-		select {
-		case <-sm.shutdown:
-		case <-time.After(20 * time.Millisecond):
-			t.Errorf("Received no shutdown command for signal %s", sig)
+
+	links := map[string]int{"/logo.png": 1, "/about": 1}
+	newPages := sm.addLinkedPages(links, map[string]bool{"/logo.png": true}, 1)
+	if len(newPages) != 2 {
+		t.Fatalf("Got %d new pages, want 2", len(newPages))
+	}
+	if !sm.pages["/logo.png"].resource || sm.pages["/about"].resource {
+		t.Errorf("Got resource %t for /logo.png and %t for /about", sm.pages["/logo.png"].resource, sm.pages["/about"].resource)
+	}
+
+	// A checked resource later linked to as a page is returned to be crawled.
+	sm.pages["/logo.png"].visited = true
+	newPages = sm.addLinkedPages(map[string]int{"/logo.png": 1}, nil, 1)
+	if len(newPages) != 1 || newPages[0] != sm.pages["/logo.png"] {
+		t.Fatalf("Got new pages %v, want /logo.png", newPages)
+	}
+	if p := sm.pages["/logo.png"]; p.resource || p.visited {
+		t.Errorf("Got resource %t visited %t after a page link", p.resource, p.visited)
+	}
+}
+
+func TestStartCancel(t *testing.T) {
+	requested := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(requested)
+		<-r.Context().Done() // only the cancelled request ends the response
+	}))
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.IgnoreRobots = true
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-requested
+		cancel()
+	}()
+	done := make(chan error)
+	go func() { done <- sm.Start(ctx) }()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Got Start error %v, want %v", err, context.Canceled)
 		}
+	case <-time.After(time.Second):
+		t.Fatal("Start did not return after its context was cancelled")
+	}
+
+	if got, want := sm.state, stateStopped; got != want {
+		t.Errorf("Got state %q, want %q", got, want)
+	}
+	if sm.pages[sm.start].visited {
+		t.Error("Start page visited after the crawl was cancelled")
 	}
 }
 
@@ -172,17 +219,17 @@ func TestStart(t *testing.T) {
 			visited: true,
 		},
 		"/hello-world": {
-			links:   map[string]int{"/": 1, "/values": 1},
+			links:   map[string]int{"/": 1, "/values": 1, "/play.png": 1, "/site.css": 1},
 			url:     baseURL.ResolveReference(&url.URL{Path: "/hellow-world"}),
 			visited: true,
 		},
 		"/values": {
-			links:   map[string]int{"/": 1, "/variables": 1},
+			links:   map[string]int{"/": 1, "/variables": 1, "/play.png": 1, "/site.css": 1},
 			url:     baseURL.ResolveReference(&url.URL{Path: "/values"}),
 			visited: true,
 		},
 		"/variables": {
-			links:   map[string]int{"/": 1, "/constants": 1},
+			links:   map[string]int{"/": 1, "/constants": 1, "/play.png": 1, "/site.css": 1},
 			url:     baseURL.ResolveReference(&url.URL{Path: "/variables"}),
 			visited: true,
 		},
@@ -192,6 +239,20 @@ func TestStart(t *testing.T) {
 			url:     baseURL.ResolveReference(&url.URL{Path: "/constants"}),
 			visited: true,
 		},
+		"/play.png": {
+			links:    map[string]int{},
+			broken:   true,
+			resource: true,
+			url:      baseURL.ResolveReference(&url.URL{Path: "/play.png"}),
+			visited:  true,
+		},
+		"/site.css": {
+			links:    map[string]int{},
+			broken:   true,
+			resource: true,
+			url:      baseURL.ResolveReference(&url.URL{Path: "/site.css"}),
+			visited:  true,
+		},
 	}
 
 	u, err := url.Parse(server.URL + "/hello-world")
@@ -204,7 +265,7 @@ func TestStart(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if err := sm.Start(); err != nil {
+	if err := sm.Start(context.Background()); err != nil {
 		t.Errorf("Start error: %v", err)
 	}
 
@@ -220,5 +281,184 @@ func TestStart(t *testing.T) {
 		if !reflect.DeepEqual(page.links, wantPage.links) {
 			t.Errorf("Path %q got links\n%v\nwant links\n%v\n", path, page.links, wantPage.links)
 		}
+		if page.resource != wantPage.resource || page.broken != wantPage.broken {
+			t.Errorf("Path %q got resource %t broken %t, want %t %t", path, page.resource, page.broken, wantPage.resource, wantPage.broken)
+		}
+	}
+	if kind := sm.pages["/values"].kinds["/site.css"]; kind != linkStylesheet {
+		t.Errorf("Got link kind %q for the stylesheet, want %q", kind, linkStylesheet)
+	}
+}
+
+func TestStartRobots(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	mux.Handle("/", http.FileServer(http.Dir("testdata")))
+	mux.HandleFunc("/robots.txt", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "User-agent: *\nDisallow: /values\n\nSitemap: %s/sitemap.xml\n", server.URL)
+	})
+	mux.HandleFunc("/sitemap.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<urlset xmlns="http://www.sitemaps.org/schemas/sitemap/0.9"><url><loc>%s/extra</loc></url></urlset>`, server.URL)
+	})
+
+	wantSkipped := map[string]string{
+		"/":            "",
+		"/hello-world": "",
+		"/values":      skipRobots,
+		"/variables":   "",
+		"/constants":   "",
+		"/extra":       "",
+		"/play.png":    "",
+		"/site.css":    "",
+	}
+
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.SeedFromSitemaps = true
+
+	if err := sm.Start(context.Background()); err != nil {
+		t.Errorf("Start error: %v", err)
+	}
+
+	if got, want := sm.RobotsSitemaps(), []string{server.URL + "/sitemap.xml"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got robots sitemaps %v, want %v", got, want)
+	}
+	if got, want := len(sm.pages), len(wantSkipped); got != want {
+		t.Errorf("Got %d pages, want %d", got, want)
+	}
+	for path, p := range sm.pages {
+		want, ok := wantSkipped[path]
+		if !ok {
+			t.Errorf("Got unwanted path %q", path)
+			continue
+		}
+		if p.skipped != want {
+			t.Errorf("Path %q got skipped %q, want %q", path, p.skipped, want)
+		}
+		if p.visited == (want != "") {
+			t.Errorf("Path %q got visited %t", path, p.visited)
+		}
+	}
+
+	sm.IgnoreRobots = true
+	sm.pages["/values"].skipped = ""
+	if err := sm.Start(context.Background()); err != nil {
+		t.Errorf("Start error: %v", err)
+	}
+	if !sm.pages["/values"].visited {
+		t.Error("Page /values unvisited with robots.txt ignored")
+	}
+}
+
+func TestStartRobotsUnavailable(t *testing.T) {
+	tests := []struct {
+		status       int
+		ignoreRobots bool
+		skipped      string
+	}{
+		{http.StatusNotFound, false, ""},
+		{http.StatusForbidden, false, ""},
+		{http.StatusServiceUnavailable, false, skipRobots},
+		{http.StatusServiceUnavailable, true, ""},
+	}
+	for _, test := range tests {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/robots.txt" {
+				w.WriteHeader(test.status)
+			}
+		}))
+
+		sm, err := NewSiteMap(server.URL, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sm.IgnoreRobots = test.ignoreRobots
+		if err := sm.Start(context.Background()); err != nil {
+			t.Errorf("Start error: %v", err)
+		}
+		server.Close()
+
+		p := sm.pages["/"]
+		if p.skipped != test.skipped || p.visited == (test.skipped != "") {
+			t.Errorf("robots.txt status %d, ignored %t: got skipped %q visited %t, want skipped %q",
+				test.status, test.ignoreRobots, p.skipped, p.visited, test.skipped)
+		}
+	}
+}
+
+func TestStartRedirects(t *testing.T) {
+	server := newRedirectServer()
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/old", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Errorf("Start error: %v", err)
+	}
+
+	// the redirect edge goes directly to the end of the chain
+	wantRedirects := map[string]string{"/old": "/hello-world"}
+	for path, want := range wantRedirects {
+		p, ok := sm.pages[path]
+		if !ok {
+			t.Errorf("Missing page %q", path)
+			continue
+		}
+		if p.redirect != want {
+			t.Errorf("Path %q got redirect %q, want %q", path, p.redirect, want)
+		}
+		if p.broken {
+			t.Errorf("Path %q is broken", path)
+		}
+	}
+	if _, ok := sm.pages["/older"]; ok {
+		t.Error("Got a page for the intermediate redirect /older")
+	}
+	for _, path := range []string{"/hello-world", "/values", "/variables", "/constants"} {
+		if p, ok := sm.pages[path]; !ok || !p.visited {
+			t.Errorf("Path %q missing or unvisited", path)
+		}
+	}
+
+	j, err := sm.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got smJSON
+	if err := json.Unmarshal(j, &got); err != nil {
+		t.Fatal(err)
+	}
+	var redirects int
+	for _, e := range got.Edges {
+		if e.Kind == edgeRedirect {
+			redirects++
+		}
+	}
+	if redirects != len(wantRedirects) {
+		t.Errorf("Got %d redirect edges, want %d", redirects, len(wantRedirects))
+	}
+}
+
+func TestDepths(t *testing.T) {
+	sm, err := NewSiteMap("http://testsite.com/start", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.pages["/start"].links = map[string]int{"/a": 1, "/b": 1}
+	sm.addPages(sm.pages["/start"].links)
+	sm.pages["/a"].links = map[string]int{"/b": 1, "/c": 1}
+	sm.addPages(sm.pages["/a"].links)
+	sm.pages["/c"].redirect = "/d"
+	sm.addPages(map[string]int{"/d": 1, "/orphan": 1})
+
+	want := map[string]int{"/start": 0, "/a": 1, "/b": 1, "/c": 2, "/d": 3}
+	if got := sm.depths(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got depths %v, want %v", got, want)
 	}
 }
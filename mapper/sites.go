@@ -0,0 +1,255 @@
+package mapper
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// siteHosts are the hosts, normalized with Normalizer.host, of the sites in a
+// crawl. Pages on the first site are keyed by their path and those on the
+// others by "//" followed by their host and path, a network-path reference
+// which resolves against the first site's URL to the page.
+type siteHosts struct {
+	hosts      []string
+	aliases    map[string]string // normalized alias hosts to the host they are merged into
+	subdomains bool              // also include the hosts sharing a registrable domain with a site
+}
+
+// host returns the host of u normalized by n, replacing an alias with the
+// host it is merged into.
+func (s *siteHosts) host(u *url.URL, n *Normalizer) string {
+	host := n.host(u)
+	if merged, ok := s.aliases[host]; ok {
+		return merged
+	}
+	return host
+}
+
+// key returns the key of the page at u with its path normalized by n, false
+// if u is not on one of the sites.
+func (s *siteHosts) key(u *url.URL, n *Normalizer) (string, bool) {
+	host := s.host(u, n)
+	if s.site(host) < 0 {
+		return "", false
+	}
+	if host == s.hosts[0] {
+		return n.key(u), true
+	}
+	return "//" + host + n.key(u), true
+}
+
+// site returns the index of the site host is on, -1 if it is on none of
+// them. With subdomains a host on the registrable domain of a site is on the
+// first such site unless it is the host of another.
+func (s *siteHosts) site(host string) int {
+	for i, h := range s.hosts {
+		if h == host {
+			return i
+		}
+	}
+	if !s.subdomains {
+		return -1
+	}
+	domain := registrableDomain(host)
+	for i, h := range s.hosts {
+		if registrableDomain(h) == domain {
+			return i
+		}
+	}
+	return -1
+}
+
+// registrableDomain returns the domain of host one level below its public
+// suffix, ie example.co.uk for www.example.co.uk, or the host itself if it
+// has none such as for an IP address.
+func registrableDomain(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	domain, err := publicsuffix.EffectiveTLDPlusOne(host)
+	if err != nil {
+		return host
+	}
+	return domain
+}
+
+// siteHost returns the host in the key of a page on one of the other sites
+// of a crawl, an empty string for pages on the first site.
+func siteHost(key string) string {
+	if !strings.HasPrefix(key, "//") {
+		return ""
+	}
+	host := key[2:]
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	return host
+}
+
+// SiteSummary counts the pages of one site in a crawl.
+type SiteSummary struct {
+	Host    string `json:"host"`
+	URL     string `json:"url"` // the starting page
+	Pages   int    `json:"pages"`
+	Visited int    `json:"visited"`
+	Broken  int    `json:"broken"`
+}
+
+// parseStart parses the URL of a starting page, assuming http if no scheme
+// is given.
+func parseStart(startPage string) (*url.URL, error) {
+	start, err := url.Parse(startPage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse page %q: %v", startPage, err)
+	}
+
+	if start.Scheme == "" {
+		log.Printf("No URL scheme specified using 'http'")
+		start, err = url.Parse("http://" + startPage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse page %q: %v", "http://"+startPage, err)
+		}
+	}
+	if start.Path == "" {
+		start.Path = "/"
+	}
+	return start, nil
+}
+
+// AddSite adds another site to be crawled along with the site of the URL
+// given to NewSiteMap, beginning at startPage. The sites are crawled
+// together by the same workers and links between them are followed as
+// links within a site. Pages on the added sites are keyed by "//" followed
+// by their host and path, see Sites.
+func (sm *SiteMap) AddSite(startPage string) error {
+	start, err := parseStart(startPage)
+	if err != nil {
+		return err
+	}
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sites := sm.hosts()
+	host := sites.host(start, &sm.Normalization)
+	for _, h := range sites.hosts {
+		if h == host {
+			return fmt.Errorf("the site %s is already being crawled", start.Host)
+		}
+	}
+	sites.hosts = append(sites.hosts, host)
+	key, _ := sites.key(start, &sm.Normalization)
+	sm.pages[key] = newPage(start)
+	sm.others = append(sm.others, key)
+	return nil
+}
+
+// Sites returns the URL of the starting page of each site in the crawl,
+// beginning with the site given to NewSiteMap.
+func (sm *SiteMap) Sites() []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	var sites []string
+	for _, key := range sm.startKeys() {
+		sites = append(sites, sm.pages[key].url.String())
+	}
+	return sites
+}
+
+// SiteSummaries returns the page counts of each site in the crawl in the
+// order of Sites.
+func (sm *SiteMap) SiteSummaries() []SiteSummary {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return sm.siteSummaries()
+}
+
+// siteSummaries implements SiteSummaries, the caller must hold sm.mu.
+func (sm *SiteMap) siteSummaries() []SiteSummary {
+	summaries := make([]SiteSummary, 0, len(sm.others)+1)
+	for _, key := range sm.startKeys() {
+		start := sm.pages[key].url
+		summaries = append(summaries, SiteSummary{Host: start.Host, URL: start.String()})
+	}
+	sites := sm.hosts()
+	for path, p := range sm.pages {
+		s := &summaries[sm.siteIndex(sites, path)]
+		s.Pages++
+		if p.visited {
+			s.Visited++
+		}
+		if p.broken {
+			s.Broken++
+		}
+	}
+	return summaries
+}
+
+// siteIndex returns the index in startKeys of the site of the page keyed by
+// path.
+func (sm *SiteMap) siteIndex(sites *siteHosts, path string) int {
+	if host := siteHost(path); host != "" {
+		if i := sites.site(host); i > 0 {
+			return i
+		}
+	}
+	return 0
+}
+
+// hosts returns the hosts of the sites in the crawl along with how hosts
+// are merged into them. The caller must hold sm.mu.
+func (sm *SiteMap) hosts() *siteHosts {
+	n := &sm.Normalization
+	sites := &siteHosts{hosts: []string{n.host(sm.URL)}, subdomains: sm.Subdomains}
+	for _, key := range sm.others {
+		sites.hosts = append(sites.hosts, n.host(sm.pages[key].url))
+	}
+	if len(sm.HostAliases) > 0 {
+		sites.aliases = map[string]string{}
+		for alias, host := range sm.HostAliases {
+			// the hosts are normalized as those of URLs are
+			sites.aliases[n.host(&url.URL{Host: alias})] = n.host(&url.URL{Host: host})
+		}
+	}
+	return sites
+}
+
+// startKeys returns the keys of the starting page of each site in the crawl.
+// The caller must hold sm.mu.
+func (sm *SiteMap) startKeys() []string {
+	return append([]string{sm.start}, sm.others...)
+}
+
+// siteStart returns the starting page of the site p is on. The caller must
+// hold sm.mu.
+func (sm *SiteMap) siteStart(p *page) *page {
+	sites := sm.hosts()
+	if i := sites.site(sites.host(p.url, &sm.Normalization)); i > 0 {
+		return sm.pages[sm.others[i-1]]
+	}
+	return sm.pages[sm.start]
+}
+
+// pageURL returns the URL of the page keyed by path, using the scheme and
+// host of the starting page of its site. The caller must hold sm.mu.
+func (sm *SiteMap) pageURL(path string) (*url.URL, error) {
+	u, err := url.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	u = sm.URL.ResolveReference(u)
+	if host := siteHost(path); host != "" {
+		sites := sm.hosts()
+		if i := sites.site(host); i >= 0 {
+			start := sm.pages[sm.startKeys()[i]].url
+			u.Scheme = start.Scheme
+			if sites.hosts[i] == host {
+				u.Host = start.Host
+			}
+		}
+	}
+	return u, nil
+}
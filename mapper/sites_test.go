@@ -0,0 +1,307 @@
+package mapper
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSiteHostsKey(t *testing.T) {
+	sites := &siteHosts{hosts: []string{"first.com", "second.com"}}
+	n := &Normalizer{LowercaseHost: true, FoldTrailingSlash: true}
+	tests := []struct {
+		url      string
+		want     string
+		wantOk   bool
+		wantHost string
+	}{
+		{"http://first.com/docs/", "/docs", true, ""},
+		{"https://Second.com/docs/", "//second.com/docs", true, "second.com"},
+		{"http://second.com", "//second.com/", true, "second.com"},
+		{"http://third.com/docs", "", false, ""},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := sites.key(u, n)
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("URL %q got key %q %t, want %q %t", test.url, got, ok, test.want, test.wantOk)
+		}
+		if host := siteHost(got); host != test.wantHost {
+			t.Errorf("Key %q got site host %q, want %q", got, host, test.wantHost)
+		}
+	}
+}
+
+func TestStartSites(t *testing.T) {
+	first, second := http.NewServeMux(), http.NewServeMux()
+	firstServer, secondServer := httptest.NewServer(first), httptest.NewServer(second)
+	defer firstServer.Close()
+	defer secondServer.Close()
+	page := func(mux *http.ServeMux, path string, links ...string) {
+		mux.HandleFunc(path, func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path != path {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Content-Type", "text/html")
+			for _, link := range links {
+				fmt.Fprintf(w, `<a href="%s">link</a>`, link)
+			}
+		})
+	}
+	page(first, "/", "/a", secondServer.URL+"/")
+	page(first, "/a", "http://elsewhere.example/")
+	page(second, "/", "/b", firstServer.URL+"/a")
+	page(second, "/b")
+	second.Handle("/old", http.RedirectHandler(firstServer.URL+"/", http.StatusMovedPermanently))
+	page(second, "/links", "/old")
+
+	sm, err := NewSiteMap(firstServer.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.AddSite(secondServer.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.AddSite(firstServer.URL + "/a"); err == nil {
+		t.Error("Adding a site already crawled succeeded")
+	}
+	sm.IgnoreRobots = true
+	secondHost := "//" + secondServer.Listener.Addr().String()
+	if err := sm.AddSite(secondServer.URL + "/links"); err == nil {
+		t.Error("Adding a second start page for a site succeeded")
+	}
+	sm.addPages(map[string]int{secondHost + "/links": 1})
+	if err := sm.Start(context.Background()); err != nil {
+		t.Errorf("Start error: %v", err)
+	}
+
+	wantLinks := map[string]map[string]int{
+		"/":                   {"/a": 1, secondHost + "/": 1},
+		"/a":                  {},
+		secondHost + "/":      {secondHost + "/b": 1, "/a": 1},
+		secondHost + "/b":     {},
+		secondHost + "/links": {secondHost + "/old": 1},
+		secondHost + "/old":   {},
+	}
+	if got, want := len(sm.pages), len(wantLinks); got != want {
+		t.Errorf("Got %d pages, want %d", got, want)
+	}
+	for path, links := range wantLinks {
+		p, ok := sm.pages[path]
+		if !ok {
+			t.Errorf("Missing page %q", path)
+			continue
+		}
+		if !p.visited || p.broken {
+			t.Errorf("Page %q got visited %t broken %t", path, p.visited, p.broken)
+		}
+		if !reflect.DeepEqual(p.links, links) {
+			t.Errorf("Page %q got links %v, want %v", path, p.links, links)
+		}
+	}
+	if got := sm.pages[secondHost+"/old"].redirect; got != "/" {
+		t.Errorf("Got redirect %q between the sites, want /", got)
+	}
+	if got, want := sm.pages[secondHost+"/b"].url.String(), secondServer.URL+"/b"; got != want {
+		t.Errorf("Got URL %q, want %q", got, want)
+	}
+
+	wantSummaries := []SiteSummary{
+		{Host: firstServer.Listener.Addr().String(), URL: firstServer.URL + "/", Pages: 2, Visited: 2},
+		{Host: secondServer.Listener.Addr().String(), URL: secondServer.URL + "/", Pages: 4, Visited: 4},
+	}
+	if got := sm.SiteSummaries(); !reflect.DeepEqual(got, wantSummaries) {
+		t.Errorf("Got site summaries %+v, want %+v", got, wantSummaries)
+	}
+
+	content, err := json.Marshal(sm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var j smJSON
+	if err := json.Unmarshal(content, &j); err != nil {
+		t.Fatal(err)
+	}
+	if len(j.Sites) != 2 || j.Sites[0].Color == j.Sites[1].Color {
+		t.Errorf("Got JSON sites %+v, want two with distinct colors", j.Sites)
+	}
+	for _, n := range j.Nodes {
+		want := j.Sites[0]
+		if siteHost(n.ID) != "" {
+			want = j.Sites[1]
+		}
+		if n.Site != want.Host || n.Color != want.Color {
+			t.Errorf("Node %q got site %q color %q, want %q %q", n.ID, n.Site, n.Color, want.Host, want.Color)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := sm.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSiteMap(&buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loaded.Sites(), sm.Sites(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Got loaded sites %v, want %v", got, want)
+	}
+}
+
+func TestSiteHostsMerged(t *testing.T) {
+	sites := &siteHosts{
+		hosts:      []string{"example.com", "example.co.uk"},
+		aliases:    map[string]string{"www.example.com": "example.com"},
+		subdomains: true,
+	}
+	tests := []struct {
+		url    string
+		want   string
+		wantOk bool
+	}{
+		{"http://www.example.com/a", "/a", true},
+		{"https://example.com/a", "/a", true},
+		{"http://docs.example.com/a", "//docs.example.com/a", true},
+		{"http://shop.example.co.uk/a", "//shop.example.co.uk/a", true},
+		{"http://example.org/a", "", false},
+		{"http://co.uk/a", "", false},
+		{"http://127.0.0.1/a", "", false},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, ok := sites.key(u, nil)
+		if got != test.want || ok != test.wantOk {
+			t.Errorf("URL %q got key %q %t, want %q %t", test.url, got, ok, test.want, test.wantOk)
+		}
+	}
+	if got := sites.site("shop.example.co.uk"); got != 1 {
+		t.Errorf("Got site %d for a subdomain of the second site, want 1", got)
+	}
+}
+
+func TestStartAliases(t *testing.T) {
+	mux := http.NewServeMux()
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	port := server.Listener.Addr().(*net.TCPAddr).Port
+	alias := fmt.Sprintf("localhost:%d", port)
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html")
+		fmt.Fprintf(w, `<a href="http://%s/b">b</a><a href="https://%s/b">b</a><a href="/old">old</a>`, alias, server.Listener.Addr())
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+	})
+	mux.Handle("/old", http.RedirectHandler("http://"+alias+"/", http.StatusMovedPermanently))
+
+	sm, err := NewSiteMap(server.URL, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.IgnoreRobots = true
+	sm.HostAliases = map[string]string{alias: server.Listener.Addr().String()}
+	sm.ReportSchemeMismatch = true
+	if err := sm.Start(context.Background()); err != nil {
+		t.Errorf("Start error: %v", err)
+	}
+
+	if got, want := sm.pages["/"].links, map[string]int{"/b": 2, "/old": 1}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got links %v, want %v", got, want)
+	}
+	if got, want := sm.pages["/"].findings, []string{"links with a different scheme than http: 1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Got findings %v, want %v", got, want)
+	}
+	old := sm.pages["/old"]
+	if old.redirect != "/" || old.broken || len(old.findings) > 0 {
+		t.Errorf("Got redirect %q broken %t findings %v for a redirect to an alias", old.redirect, old.broken, old.findings)
+	}
+	if got := len(sm.pages); got != 3 {
+		t.Errorf("Got %d pages, want 3", got)
+	}
+}
+
+func TestStartSubdomainRobots(t *testing.T) {
+	var mu sync.Mutex
+	var fetched []string
+	visitedA := make(chan struct{})
+	var visitA sync.Once
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		fetched = append(fetched, r.Host+r.URL.Path)
+		mu.Unlock()
+		switch {
+		case r.URL.Path == "/robots.txt" && r.Host == "docs.site.test":
+			// the crawl of the other pages goes on while robots.txt is retrieved
+			select {
+			case <-visitedA:
+			case <-time.After(5 * time.Second):
+				t.Error("The crawl waited for the subdomain's robots.txt")
+			}
+			fmt.Fprint(w, "User-agent: *\nDisallow: /\n")
+		case r.URL.Path == "/robots.txt":
+			http.NotFound(w, r)
+		case r.URL.Path == "/a":
+			visitA.Do(func() { close(visitedA) })
+		default:
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, `<a href="http://docs.site.test/private">private</a><a href="http://blog.site.test/excluded">excluded</a><a href="/a">a</a>`)
+		}
+	}))
+	defer server.Close()
+
+	sm, err := NewSiteMap("http://www.site.test/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Subdomains = true
+	sm.Exclude = []*regexp.Regexp{regexp.MustCompile("^/excluded$")}
+	sm.Transport = &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+
+	private, ok := sm.pages["//docs.site.test/private"]
+	if !ok {
+		t.Fatalf("Subdomain page not found in %v", sm.pages)
+	}
+	if private.visited || private.skipped != skipRobots {
+		t.Errorf("Got visited %t skipped %q for a page disallowed by the subdomain's robots.txt", private.visited, private.skipped)
+	}
+	if excluded := sm.pages["//blog.site.test/excluded"]; excluded == nil || excluded.skipped != skipScope {
+		t.Errorf("Got page %v for an out of scope subdomain page", excluded)
+	}
+	// no robots.txt is retrieved for a host with only out of scope pages
+	want := []string{"docs.site.test/robots.txt", "www.site.test/", "www.site.test/a", "www.site.test/robots.txt"}
+	mu.Lock()
+	defer mu.Unlock()
+	sort.Strings(fetched)
+	if !reflect.DeepEqual(fetched, want) {
+		t.Errorf("Got requests %v, want %v", fetched, want)
+	}
+}
@@ -0,0 +1,235 @@
+package mapper
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// stateJSON is the saved state of a crawl from which it can be resumed.
+type stateJSON struct {
+	StartURL string                   `json:"startURL"`
+	Start    string                   `json:"start,omitempty"` // the key of the starting page, its path normalized
+	Sites    []string                 `json:"sites,omitempty"` // the keys of the starting pages of the sites added with AddSite
+	Saved    time.Time                `json:"saved"`
+	Pages    map[string]pageState     `json:"pages"`
+	Frontier []string                 `json:"frontier"`           // pages not yet visited, sorted
+	External map[string]externalState `json:"external,omitempty"` // the checked links to other sites by URL
+}
+
+// externalState is the saved result of checking a link to another site.
+type externalState struct {
+	Duration time.Duration `json:"duration,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Status   int           `json:"status,omitempty"`
+}
+
+// pageState is the saved state of a single page.
+type pageState struct {
+	Broken     bool              `json:"broken,omitempty"`
+	Canonical  string            `json:"canonical,omitempty"`
+	Depth      int               `json:"depth,omitempty"`
+	Duration   time.Duration     `json:"duration,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	ErrorClass string            `json:"errorClass,omitempty"`
+	External   map[string]int    `json:"external,omitempty"`
+	FinalURL   string            `json:"finalURL,omitempty"`
+	Findings   []string          `json:"findings,omitempty"`
+	Header     http.Header       `json:"header,omitempty"`
+	Kinds      map[string]string `json:"kinds,omitempty"`
+	Links      map[string]int    `json:"links,omitempty"`
+	Redirect   string            `json:"redirect,omitempty"`
+	Redirects  []redirect        `json:"redirects,omitempty"`
+	Resource   bool              `json:"resource,omitempty"`
+	Retries    int               `json:"retries,omitempty"`
+	Size       int64             `json:"size,omitempty"`
+	Skipped    string            `json:"skipped,omitempty"`
+	Status     int               `json:"status,omitempty"`
+	URL        string            `json:"url"`
+	Visited    bool              `json:"visited,omitempty"`
+}
+
+// Save writes the current state of the crawl to w in a form LoadSiteMap can
+// resume from.
+func (sm *SiteMap) Save(w io.Writer) error {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	state := stateJSON{
+		StartURL: sm.pages[sm.start].url.String(),
+		Start:    sm.start,
+		Saved:    time.Now().UTC(),
+		Pages:    make(map[string]pageState, len(sm.pages)),
+		Frontier: []string{},
+		Sites:    sm.others,
+	}
+	for path, p := range sm.pages {
+		ps := pageState{
+			Broken:     p.broken,
+			Canonical:  p.canonical,
+			Depth:      p.depth,
+			Duration:   p.duration,
+			ErrorClass: p.errClass,
+			External:   p.external,
+			Findings:   p.findings,
+			Header:     p.header,
+			Kinds:      p.kinds,
+			Links:      p.links,
+			Redirect:   p.redirect,
+			Redirects:  p.redirects,
+			Resource:   p.resource,
+			Retries:    p.retries,
+			Size:       p.size,
+			Skipped:    p.skipped,
+			Status:     p.status,
+			URL:        p.url.String(),
+			Visited:    p.visited,
+		}
+		if p.err != nil {
+			ps.Error = p.err.Error()
+		}
+		if p.finalURL != nil {
+			ps.FinalURL = p.finalURL.String()
+		}
+		state.Pages[path] = ps
+		if !p.visited {
+			state.Frontier = append(state.Frontier, path)
+		}
+	}
+	sort.Strings(state.Frontier)
+	for u, l := range sm.external {
+		if !l.checked {
+			continue
+		}
+		if state.External == nil {
+			state.External = map[string]externalState{}
+		}
+		es := externalState{Duration: l.duration, Status: l.status}
+		if l.err != nil {
+			es.Error = l.err.Error()
+		}
+		state.External[u] = es
+	}
+	// encoding happens under the lock as the page maps and slices are shared
+	return json.NewEncoder(w).Encode(state)
+}
+
+// SaveFile writes the crawl state to the named file. The state is written to
+// a temporary file first which then replaces the named file so an existing
+// checkpoint is never left partially written.
+func (sm *SiteMap) SaveFile(name string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".tmp")
+	if err != nil {
+		return err
+	}
+	if err := sm.Save(tmp); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), name)
+}
+
+// LoadSiteMap returns a SiteMap rebuilt from a state written by Save. When
+// started only the pages which were not yet visited are crawled.
+func LoadSiteMap(r io.Reader, workerCount uint) (*SiteMap, error) {
+	var state stateJSON
+	if err := json.NewDecoder(r).Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to decode saved crawl: %v", err)
+	}
+	sm, err := NewSiteMap(state.StartURL, workerCount)
+	if err != nil {
+		return nil, err
+	}
+	if state.Start != "" && state.Start != sm.start {
+		// the starting page is replaced by the saved one keyed when normalized
+		delete(sm.pages, sm.start)
+		sm.start = state.Start
+	}
+
+	for path, ps := range state.Pages {
+		u, err := url.Parse(ps.URL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL for saved page %q: %v", path, err)
+		}
+		p := newPage(u)
+		p.broken = ps.Broken
+		p.canonical = ps.Canonical
+		p.depth = ps.Depth
+		p.duration = ps.Duration
+		p.errClass = ps.ErrorClass
+		p.findings = ps.Findings
+		p.header = ps.Header
+		p.redirect = ps.Redirect
+		p.redirects = ps.Redirects
+		p.resource = ps.Resource
+		p.retries = ps.Retries
+		p.size = ps.Size
+		p.skipped = ps.Skipped
+		p.status = ps.Status
+		p.visited = ps.Visited
+		if ps.Kinds != nil {
+			p.kinds = ps.Kinds
+		}
+		if ps.Links != nil {
+			p.links = ps.Links
+		}
+		if ps.External != nil {
+			p.external = ps.External
+		}
+		if ps.Error != "" {
+			p.err = errors.New(ps.Error)
+		}
+		if ps.FinalURL != "" {
+			if p.finalURL, err = url.Parse(ps.FinalURL); err != nil {
+				return nil, fmt.Errorf("invalid final URL for saved page %q: %v", path, err)
+			}
+		}
+		sm.pages[path] = p
+	}
+	if _, ok := sm.pages[sm.start]; !ok {
+		return nil, fmt.Errorf("missing saved starting page %q", sm.start)
+	}
+	for _, key := range state.Sites {
+		if _, ok := sm.pages[key]; !ok {
+			return nil, fmt.Errorf("missing starting page %q of a saved site", key)
+		}
+		sm.others = append(sm.others, key)
+	}
+	for u, es := range state.External {
+		l := &externalLink{checked: true, duration: es.Duration, status: es.Status, url: u}
+		if es.Error != "" {
+			l.err = errors.New(es.Error)
+		}
+		sm.external[u] = l
+	}
+	// Pages in the frontier are always crawled, even if marked visited.
+	for _, path := range state.Frontier {
+		if p, ok := sm.pages[path]; ok {
+			p.visited = false
+		}
+	}
+	return sm, nil
+}
+
+// LoadSiteMapFile returns a SiteMap rebuilt from the named file written by
+// SaveFile.
+func LoadSiteMapFile(name string, workerCount uint) (*SiteMap, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadSiteMap(f, workerCount)
+}
@@ -0,0 +1,182 @@
+package mapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestSaveLoad(t *testing.T) {
+	server := newRedirectServer()
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/old", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := sm.Save(&buf); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadSiteMap(&buf, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !reflect.DeepEqual(loaded.URL, sm.URL) || loaded.start != sm.start {
+		t.Errorf("Got url %v start %q, want %v start %q", loaded.URL, loaded.start, sm.URL, sm.start)
+	}
+	if got, want := len(loaded.pages), len(sm.pages); got != want {
+		t.Fatalf("Got %d pages, want %d", got, want)
+	}
+	for path, want := range sm.pages {
+		got, ok := loaded.pages[path]
+		if !ok {
+			t.Errorf("Missing page %q", path)
+			continue
+		}
+		if got.url.String() != want.url.String() || got.visited != want.visited || got.broken != want.broken ||
+			got.status != want.status || got.size != want.size || got.redirect != want.redirect ||
+			!reflect.DeepEqual(got.links, want.links) || !reflect.DeepEqual(got.redirects, want.redirects) ||
+			!reflect.DeepEqual(got.header, want.header) || !reflect.DeepEqual(got.err, want.err) {
+			t.Errorf("Page %q - got\n%+v\nwant\n%+v", path, got, want)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	files := http.FileServer(http.Dir("testdata"))
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		files.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	// A crawl interrupted after visiting only /hello-world
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := sm.pages["/hello-world"]
+	start.visited = true
+	start.status = http.StatusOK
+	start.links = map[string]int{"/": 1, "/values": 1}
+	sm.addPages(start.links)
+	sm.pages["/values"].broken = true
+	sm.pages["/values"].err = errors.New("a saved error")
+
+	dir, err := ioutil.TempDir("", "sitemapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "crawl.json")
+	if err := sm.SaveFile(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	resumed, err := LoadSiteMapFile(checkpoint, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed.CheckpointFile = checkpoint
+	if err := resumed.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if requests["/hello-world"] != 0 {
+		t.Error("The already visited page was crawled again")
+	}
+	for _, path := range []string{"/", "/values", "/variables", "/constants"} {
+		if requests[path] != 1 {
+			t.Errorf("Path %q requested %d times, want 1", path, requests[path])
+		}
+	}
+	if resumed.pages["/values"].broken {
+		t.Error("Frontier page /values was not recrawled")
+	}
+
+	// The finished crawl is checkpointed with an empty frontier.
+	final, err := LoadSiteMapFile(checkpoint, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(final.pages), 7; got != want {
+		t.Errorf("Got %d pages in the final checkpoint, want %d", got, want)
+	}
+	for path, p := range final.pages {
+		if !p.visited {
+			t.Errorf("Page %q unvisited in the final checkpoint", path)
+		}
+	}
+}
+
+func TestResumeNormalized(t *testing.T) {
+	var mu sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests[r.URL.Path]++
+		mu.Unlock()
+		w.Header().Set("Content-Type", "text/html")
+		if r.URL.Path == "/" || r.URL.Path == "/index.html" {
+			w.Write([]byte(`<a href="/a">a</a>`))
+		}
+	}))
+	defer server.Close()
+
+	// A crawl from /index.html keyed as / interrupted after visiting it
+	sm, err := NewSiteMap(server.URL+"/index.html", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Normalization = Normalizer{FoldIndex: true}
+	sm.normalizeStart()
+	start := sm.pages["/"]
+	start.visited = true
+	start.status = http.StatusOK
+	start.links = map[string]int{"/a": 1}
+	sm.addPages(start.links)
+
+	var saved bytes.Buffer
+	if err := sm.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := LoadSiteMap(&saved, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resumed.IgnoreRobots = true
+	resumed.Normalization = Normalizer{FoldIndex: true}
+	if err := resumed.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if resumed.start != "/" {
+		t.Errorf("Got start %q, want /", resumed.start)
+	}
+	if _, ok := resumed.pages["/index.html"]; ok {
+		t.Error("The starting page was added again by its unnormalized path")
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if requests["/index.html"] != 0 || requests["/a"] != 1 {
+		t.Errorf("Got requests %v, want only /a", requests)
+	}
+}
@@ -0,0 +1,110 @@
+package mapper
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// TransportOptions configure the HTTP transport of a crawl when the SiteMap
+// Transport is not set.
+type TransportOptions struct {
+	// Proxy is the URL of the proxy requests are sent through, nil uses the
+	// HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables.
+	Proxy *url.URL
+	// CAFile is a PEM file of certificate authorities trusted along with the
+	// system's.
+	CAFile string
+	// CertFile and KeyFile are a PEM client certificate and its key presented
+	// to servers requesting one, for mutual TLS.
+	CertFile string
+	KeyFile  string
+	// InsecureSkipVerify accepts any server certificate, only suitable for
+	// staging sites with self-signed certificates.
+	InsecureSkipVerify bool
+	// MaxIdleConnsPerHost is the number of idle connections kept open to each
+	// host, zero uses the net/http default of 2.
+	MaxIdleConnsPerHost int
+	// DisableHTTP2 only uses HTTP/1.1.
+	DisableHTTP2 bool
+}
+
+// NewTransport returns a new http.Transport configured by o, based on the
+// settings of http.DefaultTransport which is left unmodified.
+func (o TransportOptions) NewTransport() (*http.Transport, error) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if o.Proxy != nil {
+		t.Proxy = http.ProxyURL(o.Proxy)
+	}
+	t.MaxIdleConnsPerHost = o.MaxIdleConnsPerHost
+
+	config := &tls.Config{InsecureSkipVerify: o.InsecureSkipVerify}
+	if o.CAFile != "" {
+		pem, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CAFile)
+		}
+		config.RootCAs = pool
+	}
+	if o.CertFile != "" || o.KeyFile != "" {
+		if o.CertFile == "" || o.KeyFile == "" {
+			return nil, errors.New("a client certificate needs both a certificate and key file")
+		}
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	t.TLSClientConfig = config
+
+	// a custom TLS config turns off HTTP/2 unless it is forced
+	t.ForceAttemptHTTP2 = !o.DisableHTTP2
+	if o.DisableHTTP2 {
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return t, nil
+}
+
+// transport returns the RoundTripper for a crawl of sm, sm.Fetcher or
+// sm.Transport if set or otherwise a new one built from sm.TransportOptions,
+// and the RoundTripper checking links to other sites. Those are never
+// fetched from sm.Fetcher, which only has the pages of the crawl, but over
+// the network as the crawl would be without it. Close is set for a new
+// transport to close its idle connections once the crawl is done.
+func (sm *SiteMap) transport() (rt, external http.RoundTripper, close func(), err error) {
+	rt, close = sm.Transport, func() {}
+	if rt == nil && (sm.Fetcher == nil || sm.CheckExternal) {
+		t, err := sm.TransportOptions.NewTransport()
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		rt, close = t, t.CloseIdleConnections
+	}
+	if sm.Fetcher != nil {
+		return fetcherTransport{sm.Fetcher}, rt, close, nil
+	}
+	return rt, rt, close, nil
+}
+
+// setTransport makes the clients of c use rt for their requests and external
+// for checking links to other sites, each request timing out after timeout,
+// none if it is zero.
+func (c *crawler) setTransport(rt, external http.RoundTripper, timeout time.Duration) {
+	c.client.Transport = rt
+	c.client.Timeout = timeout
+	c.externalClient.Transport = external
+	c.externalClient.Timeout = timeout
+}
@@ -0,0 +1,146 @@
+package mapper
+
+import (
+	"context"
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+func TestNewTransport(t *testing.T) {
+	tr, err := TransportOptions{MaxIdleConnsPerHost: 8, DisableHTTP2: true}.NewTransport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr == http.DefaultTransport {
+		t.Error("Got the default transport")
+	}
+	if tr.MaxIdleConnsPerHost != 8 {
+		t.Errorf("Got %d max idle connections per host, want 8", tr.MaxIdleConnsPerHost)
+	}
+	if tr.ForceAttemptHTTP2 || tr.TLSNextProto == nil {
+		t.Error("HTTP/2 not disabled")
+	}
+
+	if _, err := (TransportOptions{CertFile: "cert.pem"}).NewTransport(); err == nil {
+		t.Error("No error for a client certificate without a key")
+	}
+	if _, err := (TransportOptions{CAFile: "missing.pem"}).NewTransport(); err == nil {
+		t.Error("No error for a missing CA file")
+	}
+}
+
+func TestStartTLS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, ca, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		options TransportOptions
+		broken  bool
+	}{
+		{"untrusted", TransportOptions{}, true},
+		{"ca file", TransportOptions{CAFile: caFile}, false},
+		{"insecure", TransportOptions{InsecureSkipVerify: true}, false},
+	}
+	for _, test := range tests {
+		sm, err := NewSiteMap(server.URL, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sm.Retries = 0
+		sm.IgnoreRobots = true // an unreachable robots.txt would block the site
+		sm.TransportOptions = test.options
+		if err := sm.Start(context.Background()); err != nil {
+			t.Fatalf("%s: Start error: %v", test.name, err)
+		}
+		p := sm.pages["/"]
+		if p.broken != test.broken {
+			t.Errorf("%s: got broken %v, want %v, error %v", test.name, p.broken, test.broken, p.err)
+		}
+		if test.broken && p.errClass != errorTLS {
+			t.Errorf("%s: got error class %q, want %q", test.name, p.errClass, errorTLS)
+		}
+	}
+}
+
+func TestStartProxy(t *testing.T) {
+	var mu sync.Mutex
+	var proxied []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		proxied = append(proxied, r.URL.String())
+		mu.Unlock()
+	}))
+	defer proxy.Close()
+
+	sm, err := NewSiteMap("http://site.invalid/", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sm.TransportOptions.Proxy, err = url.Parse(proxy.URL); err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	if p := sm.pages["/"]; p.broken {
+		t.Errorf("Page not fetched through the proxy: %v", p.err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(proxied) != 2 || proxied[1] != "http://site.invalid/" {
+		t.Errorf("Got proxied requests %v, want robots.txt and the page", proxied)
+	}
+}
+
+// roundTripFunc is an http.RoundTripper calling itself.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestStartTransport(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	var mu sync.Mutex
+	requests := 0
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Transport = roundTripFunc(func(req *http.Request) (*http.Response, error) {
+		mu.Lock()
+		requests++
+		mu.Unlock()
+		return http.DefaultTransport.RoundTrip(req)
+	})
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// robots.txt and each page
+	if got, want := requests, len(sm.pages)+1; got != want {
+		t.Errorf("Got %d requests through the transport, want %d", got, want)
+	}
+}
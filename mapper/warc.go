@@ -0,0 +1,192 @@
+package mapper
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// warcRecord is a single record of a WARC archive.
+type warcRecord struct {
+	header textproto.MIMEHeader
+	block  []byte
+}
+
+// targetURI returns the WARC-Target-URI of r, without the angle brackets
+// some writers add.
+func (r *warcRecord) targetURI() string {
+	return strings.TrimSuffix(strings.TrimPrefix(r.header.Get("WARC-Target-URI"), "<"), ">")
+}
+
+// readWARCRecord reads the next record from r, returning io.EOF when there
+// are no more.
+func readWARCRecord(r *bufio.Reader) (*warcRecord, error) {
+	// records are separated by blank lines
+	var version string
+	for version == "" {
+		line, err := r.ReadString('\n')
+		if err == io.EOF && strings.TrimSpace(line) == "" {
+			return nil, io.EOF
+		}
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		version = strings.TrimSpace(line)
+	}
+	if !strings.HasPrefix(version, "WARC/") {
+		return nil, fmt.Errorf("invalid WARC record version %q", version)
+	}
+	header, err := textproto.NewReader(r).ReadMIMEHeader()
+	if err != nil {
+		return nil, fmt.Errorf("invalid WARC record header: %v", err)
+	}
+	length, err := strconv.ParseInt(header.Get("Content-Length"), 10, 64)
+	if err != nil || length < 0 {
+		return nil, fmt.Errorf("invalid WARC record Content-Length %q", header.Get("Content-Length"))
+	}
+	block := make([]byte, length)
+	if _, err := io.ReadFull(r, block); err != nil {
+		return nil, fmt.Errorf("truncated WARC record %s: %v", header.Get("WARC-Record-ID"), err)
+	}
+	return &warcRecord{header: header, block: block}, nil
+}
+
+// WARCFetcher is a Fetcher replaying the responses recorded in WARC
+// archives, entirely offline. Requests for a URL without a response in the
+// archives fail. The archives are held in memory.
+type WARCFetcher struct {
+	responses map[string]*warcRecord // response and revisit records by target URI, the last recorded wins
+	payloads  map[string]*warcRecord // response records by payload digest, for revisit records
+}
+
+// NewWARCFetcher returns a WARCFetcher with no responses, add them with Read.
+func NewWARCFetcher() *WARCFetcher {
+	return &WARCFetcher{responses: map[string]*warcRecord{}, payloads: map[string]*warcRecord{}}
+}
+
+// LoadWARCFiles returns a WARCFetcher replaying the named WARC files, which
+// may be gzipped.
+func LoadWARCFiles(names ...string) (*WARCFetcher, error) {
+	f := NewWARCFetcher()
+	for _, name := range names {
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		err = f.Read(file)
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read WARC file %s: %v", name, err)
+		}
+	}
+	return f, nil
+}
+
+// Read adds the response and revisit records of the WARC archive read from r
+// to f. Gzipped archives, whether the file as a whole or each record, are
+// decompressed.
+func (f *WARCFetcher) Read(r io.Reader) error {
+	br := bufio.NewReader(r)
+	if magic, err := br.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		// gzip.Reader reads each of the concatenated gzip members of per record compression
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+	for {
+		record, err := readWARCRecord(br)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch record.header.Get("WARC-Type") {
+		case "response":
+			f.responses[record.targetURI()] = record
+			if digest := record.header.Get("WARC-Payload-Digest"); digest != "" {
+				f.payloads[digest] = record
+			}
+		case "revisit":
+			f.responses[record.targetURI()] = record
+		}
+	}
+}
+
+// Fetch implements the Fetcher interface.
+func (f *WARCFetcher) Fetch(req *http.Request) (*http.Response, error) {
+	u := *req.URL
+	u.Fragment = ""
+	record, ok := f.responses[u.String()]
+	if !ok {
+		return nil, fmt.Errorf("%s is not in the WARC archive", &u)
+	}
+	if record.header.Get("WARC-Type") == "revisit" {
+		return f.revisit(record, req)
+	}
+	return readRecordedResponse(record.block, req)
+}
+
+// revisit returns the response to req recorded by a revisit record, the
+// headers of which are in the record and the body in the response record
+// it refers to by payload digest or URI.
+func (f *WARCFetcher) revisit(record *warcRecord, req *http.Request) (*http.Response, error) {
+	original, ok := f.payloads[record.header.Get("WARC-Payload-Digest")]
+	if !ok {
+		original, ok = f.responses[record.header.Get("WARC-Refers-To-Target-URI")]
+	}
+	if !ok || original.header.Get("WARC-Type") != "response" {
+		return nil, fmt.Errorf("the response revisited for %s is not in the WARC archive", record.targetURI())
+	}
+	resp, err := readRecordedResponse(original.block, req)
+	if err != nil || len(bytes.TrimSpace(record.block)) == 0 {
+		return resp, err
+	}
+	// the revisit record has the headers of the later response
+	revisit, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(record.block)), req)
+	if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	revisit.Body.Close()
+	revisit.Body = resp.Body
+	revisit.ContentLength = resp.ContentLength
+	return revisit, nil
+}
+
+// readRecordedResponse parses the HTTP response recorded in a WARC block,
+// decompressing a gzip Content-Encoding as net/http does for a live
+// response.
+func readRecordedResponse(block []byte, req *http.Request) (*http.Response, error) {
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(block)), req)
+	if err != nil {
+		return nil, err
+	}
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") && req.Method != http.MethodHead {
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		resp.Body = zr
+		resp.Header.Del("Content-Encoding")
+		resp.Header.Del("Content-Length")
+		resp.ContentLength = -1
+	}
+	return resp, nil
+}
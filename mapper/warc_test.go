@@ -0,0 +1,124 @@
+package mapper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// testWARCRecord returns a WARC record of the given type and target URI
+// with the HTTP message block.
+func testWARCRecord(warcType, uri, digest, block string) string {
+	header := fmt.Sprintf("WARC/1.1\r\nWARC-Type: %s\r\nWARC-Target-URI: %s\r\n", warcType, uri)
+	if digest != "" {
+		header += "WARC-Payload-Digest: " + digest + "\r\n"
+	}
+	return fmt.Sprintf("%sContent-Length: %d\r\n\r\n%s\r\n\r\n", header, len(block), block)
+}
+
+// testHTTPResponse returns an HTTP response message with the body.
+func testHTTPResponse(status string, header string, body string) string {
+	return fmt.Sprintf("HTTP/1.1 %s\r\n%sContent-Length: %d\r\n\r\n%s", status, header, len(body), body)
+}
+
+// testWARC returns the records of a small site with a page linking to a
+// gzip encoded page, a revisit of it and a page missing from the archive.
+func testWARC() []string {
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	fmt.Fprint(zw, `<a href="/">home</a>`)
+	zw.Close()
+	return []string{
+		testWARCRecord("warcinfo", "", "", "software: test\r\n"),
+		testWARCRecord("request", "http://site.test/", "", "GET / HTTP/1.1\r\nHost: site.test\r\n\r\n"),
+		testWARCRecord("response", "http://site.test/", "",
+			testHTTPResponse("200 OK", "Content-Type: text/html\r\n", `<a href="/a">a</a><a href="/b">b</a><a href="/gone">gone</a>`)),
+		testWARCRecord("response", "<http://site.test/a>", "sha1:AAAA",
+			testHTTPResponse("200 OK", "Content-Type: text/html\r\nContent-Encoding: gzip\r\n", gzipped.String())),
+		testWARCRecord("revisit", "http://site.test/b", "sha1:AAAA", "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Encoding: gzip\r\n\r\n"),
+	}
+}
+
+func TestWARCFetcher(t *testing.T) {
+	records := testWARC()
+	var perRecord bytes.Buffer
+	for _, r := range records {
+		zw := gzip.NewWriter(&perRecord)
+		fmt.Fprint(zw, r)
+		zw.Close()
+	}
+	archives := map[string][]byte{
+		"plain":      []byte(strings.Join(records, "")),
+		"per record": perRecord.Bytes(),
+	}
+
+	for name, archive := range archives {
+		f := NewWARCFetcher()
+		if err := f.Read(bytes.NewReader(archive)); err != nil {
+			t.Fatalf("%s: Read error: %v", name, err)
+		}
+		for _, u := range []string{"http://site.test/a", "http://site.test/b"} {
+			req, err := http.NewRequest(http.MethodGet, u, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := f.Fetch(req)
+			if err != nil {
+				t.Errorf("%s: %s got error %v", name, u, err)
+				continue
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := string(body), `<a href="/">home</a>`; got != want {
+				t.Errorf("%s: %s got body %q, want %q", name, u, got, want)
+			}
+		}
+	}
+
+	f := NewWARCFetcher()
+	if err := f.Read(strings.NewReader("WARC/1.1\r\nWARC-Type: response\r\nContent-Length: 100\r\n\r\nshort")); err == nil {
+		t.Error("No error for a truncated record")
+	}
+}
+
+func TestStartWARCFetcher(t *testing.T) {
+	f := NewWARCFetcher()
+	if err := f.Read(strings.NewReader(strings.Join(testWARC(), ""))); err != nil {
+		t.Fatal(err)
+	}
+	sm, err := NewSiteMap("http://site.test/", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.Fetcher = f
+	sm.Retries = 0
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+
+	wantBroken := map[string]bool{"/": false, "/a": false, "/b": false, "/gone": true}
+	if got, want := len(sm.pages), len(wantBroken); got != want {
+		t.Errorf("Got %d pages, want %d", got, want)
+	}
+	for path, broken := range wantBroken {
+		p, ok := sm.pages[path]
+		if !ok {
+			t.Errorf("Page %q not found", path)
+			continue
+		}
+		if !p.visited || p.broken != broken {
+			t.Errorf("Path %q got visited %v broken %v, want visited broken %v", path, p.visited, p.broken, broken)
+		}
+	}
+	if got := sm.pages["/b"].links; got["/"] != 1 {
+		t.Errorf("Got links %v from the revisited page, want /", got)
+	}
+}
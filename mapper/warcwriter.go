@@ -0,0 +1,289 @@
+package mapper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultWARCMaxSize = 1 << 30  // 1 GiB, the usual size WARC files are rotated at
+	maxRecordedBody    = 50 << 20 // response bodies longer than this are truncated in the archive
+)
+
+// warcWriter writes the requests and responses of a crawl as WARC 1.1 files
+// named prefix-timestamp-serial.warc.gz, with each record gzipped separately
+// so a record can be read without decompressing the whole file. A new file is
+// started once the current one reaches maxSize bytes, zero never rotates.
+type warcWriter struct {
+	prefix  string
+	maxSize int64
+	secrets []string // the request headers left out of the archive
+	started string   // the timestamp in the file names
+
+	mu     sync.Mutex
+	file   *os.File
+	serial int
+	size   int64
+}
+
+// newWARCWriter returns a warcWriter creating files named from prefix. No
+// file is created until the first record is written. The credentials and
+// cookies of the requests, along with the extra headers in header which may
+// hold secrets, are not recorded.
+func newWARCWriter(prefix string, maxSize int64, header http.Header) *warcWriter {
+	secrets := []string{"Authorization", "Proxy-Authorization", "Cookie"}
+	for key := range header {
+		secrets = append(secrets, key)
+	}
+	return &warcWriter{prefix: prefix, maxSize: maxSize, secrets: secrets, started: time.Now().UTC().Format("20060102150405")}
+}
+
+// warcField is a single named field of a WARC record header.
+type warcField struct {
+	name, value string
+}
+
+// writeRecord writes a WARC record with the given type, header fields and
+// block, rotating to a new file first if the current one is full.
+func (w *warcWriter) writeRecord(warcType string, fields []warcField, block []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.file != nil && w.maxSize > 0 && w.size >= w.maxSize {
+		if err := w.close(); err != nil {
+			return err
+		}
+	}
+	if w.file == nil {
+		if err := w.open(); err != nil {
+			return err
+		}
+	}
+	return w.write(warcType, fields, block)
+}
+
+// open starts the next file beginning with a warcinfo record. The caller
+// must hold w.mu.
+func (w *warcWriter) open() error {
+	w.serial++
+	name := fmt.Sprintf("%s-%s-%05d.warc.gz", w.prefix, w.started, w.serial)
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w.file, w.size = file, 0
+	info := "software: sitemapper\r\nformat: WARC File Format 1.1\r\n"
+	return w.write("warcinfo", []warcField{
+		{"WARC-Filename", filepath.Base(name)},
+		{"Content-Type", "application/warc-fields"},
+	}, []byte(info))
+}
+
+// write writes a gzipped record to the current file. The caller must hold
+// w.mu.
+func (w *warcWriter) write(warcType string, fields []warcField, block []byte) error {
+	var header bytes.Buffer
+	fmt.Fprintf(&header, "WARC/1.1\r\nWARC-Type: %s\r\n", warcType)
+	for _, f := range fields {
+		fmt.Fprintf(&header, "%s: %s\r\n", f.name, f.value)
+	}
+	if fieldValue(fields, "WARC-Record-ID") == "" {
+		fmt.Fprintf(&header, "WARC-Record-ID: %s\r\n", newRecordID())
+	}
+	if fieldValue(fields, "WARC-Date") == "" {
+		fmt.Fprintf(&header, "WARC-Date: %s\r\n", time.Now().UTC().Format(time.RFC3339))
+	}
+	fmt.Fprintf(&header, "WARC-Block-Digest: %s\r\nContent-Length: %d\r\n\r\n", digest(block), len(block))
+
+	counter := &countingWriter{w: w.file}
+	zw := gzip.NewWriter(counter)
+	for _, b := range [][]byte{header.Bytes(), block, []byte("\r\n\r\n")} {
+		if _, err := zw.Write(b); err != nil {
+			return err
+		}
+	}
+	err := zw.Close()
+	w.size += counter.n
+	return err
+}
+
+// Close closes the current file.
+func (w *warcWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.close()
+}
+
+// close implements Close, the caller must hold w.mu.
+func (w *warcWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
+
+// record wraps the body of resp, the response to req, so that once it is
+// closed the request and response are written to w. The body is recorded as
+// read by the crawler and the rest of it read on close.
+func (w *warcWriter) record(req *http.Request, resp *http.Response) {
+	resp.Body = &recordingBody{ReadCloser: resp.Body, req: req, resp: resp, w: w, date: time.Now().UTC()}
+}
+
+// recordingBody keeps a copy of a response body as it is read and writes the
+// exchange to a warcWriter when closed.
+type recordingBody struct {
+	io.ReadCloser
+	body      bytes.Buffer
+	date      time.Time
+	once      sync.Once
+	req       *http.Request
+	resp      *http.Response
+	truncated bool
+	w         *warcWriter
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.keep(p[:n])
+	return n, err
+}
+
+// keep adds p to the recorded body up to maxRecordedBody.
+func (b *recordingBody) keep(p []byte) {
+	if room := maxRecordedBody - b.body.Len(); len(p) > room {
+		if room < 0 {
+			room = 0
+		}
+		p = p[:room]
+		b.truncated = true
+	}
+	b.body.Write(p)
+}
+
+func (b *recordingBody) Close() error {
+	b.once.Do(func() {
+		// read what the crawler left so the archive has the whole response
+		buf := make([]byte, 32*1024)
+		for !b.truncated {
+			n, err := b.ReadCloser.Read(buf)
+			b.keep(buf[:n])
+			if err != nil {
+				break
+			}
+		}
+		if err := b.write(); err != nil {
+			log.Printf("Failed to write WARC records for %s: %v", b.req.URL, err)
+		}
+	})
+	return b.ReadCloser.Close()
+}
+
+// write writes the request and response records of the exchange.
+func (b *recordingBody) write() error {
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "%s %s HTTP/1.1\r\nHost: %s\r\n", b.req.Method, b.req.URL.RequestURI(), b.req.URL.Host)
+	reqHeader := b.req.Header.Clone()
+	for _, key := range b.w.secrets {
+		reqHeader.Del(key)
+	}
+	reqHeader.Write(&request)
+	request.WriteString("\r\n")
+
+	var response bytes.Buffer
+	fmt.Fprintf(&response, "HTTP/%d.%d %s\r\n", b.resp.ProtoMajor, b.resp.ProtoMinor, statusLine(b.resp))
+	header := http.Header{}
+	for key, values := range b.resp.Header {
+		header[key] = values
+	}
+	// the body is recorded as received by the crawler, decoded and unchunked
+	header.Del("Transfer-Encoding")
+	if b.resp.Uncompressed {
+		header.Del("Content-Encoding")
+	}
+	header.Set("Content-Length", strconv.Itoa(b.body.Len()))
+	header.Write(&response)
+	response.WriteString("\r\n")
+	response.Write(b.body.Bytes())
+
+	date := b.date.Format(time.RFC3339)
+	responseID := newRecordID()
+	fields := []warcField{
+		{"WARC-Record-ID", responseID},
+		{"WARC-Date", date},
+		{"WARC-Target-URI", b.req.URL.String()},
+		{"WARC-Payload-Digest", digest(b.body.Bytes())},
+		{"Content-Type", "application/http;msgtype=response"},
+	}
+	if b.truncated {
+		fields = append(fields, warcField{"WARC-Truncated", "length"})
+	}
+	if err := b.w.writeRecord("response", fields, response.Bytes()); err != nil {
+		return err
+	}
+	return b.w.writeRecord("request", []warcField{
+		{"WARC-Date", date},
+		{"WARC-Target-URI", b.req.URL.String()},
+		{"WARC-Concurrent-To", responseID},
+		{"Content-Type", "application/http;msgtype=request"},
+	}, request.Bytes())
+}
+
+// statusLine returns the status code and reason phrase of resp.
+func statusLine(resp *http.Response) string {
+	code := strconv.Itoa(resp.StatusCode)
+	if len(resp.Status) > len(code) && resp.Status[:len(code)] == code {
+		return resp.Status
+	}
+	return code + " " + http.StatusText(resp.StatusCode)
+}
+
+// fieldValue returns the value of the named field, an empty string if it is
+// not in fields.
+func fieldValue(fields []warcField, name string) string {
+	for _, f := range fields {
+		if f.name == name {
+			return f.value
+		}
+	}
+	return ""
+}
+
+// newRecordID returns a new WARC-Record-ID, a random UUID URN.
+func newRecordID() string {
+	var u [16]byte
+	rand.Read(u[:])
+	u[6] = u[6]&0x0f | 0x40 // version 4
+	u[8] = u[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("<urn:uuid:%x-%x-%x-%x-%x>", u[0:4], u[4:6], u[6:8], u[8:10], u[10:])
+}
+
+// digest returns the SHA-1 digest of b in the base32 form WARC files use.
+func digest(b []byte) string {
+	sum := sha1.Sum(b)
+	return "sha1:" + base32.StdEncoding.EncodeToString(sum[:])
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,173 @@
+package mapper
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestStartWARCRecord(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "warc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.WARCPrefix = filepath.Join(dir, "crawl")
+	sm.WARCMaxSize = 4096
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+
+	files, err := filepath.Glob(sm.WARCPrefix + "-*.warc.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Errorf("Got %d WARC files, want the archive rotated into several", len(files))
+	}
+
+	// each file starts with a warcinfo record and each record is a gzip member
+	types := map[string]int{}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		br := bufio.NewReader(f)
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr.Multistream(false)
+		for first := true; ; first = false {
+			record, err := readWARCRecord(bufio.NewReader(zr))
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+			warcType := record.header.Get("WARC-Type")
+			if first && warcType != "warcinfo" {
+				t.Errorf("%s starts with a %s record", name, warcType)
+			}
+			types[warcType]++
+			if err := zr.Reset(br); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			zr.Multistream(false)
+		}
+		f.Close()
+	}
+	if types["warcinfo"] != len(files) || types["request"] != types["response"] || types["response"] < len(sm.pages) {
+		t.Errorf("Got records %v for %d pages in %d files", types, len(sm.pages), len(files))
+	}
+
+	// replaying the archive gives the same crawl
+	f, err := LoadWARCFiles(files...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	replay.Fetcher = f
+	if err := replay.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+	summary := func(sm *SiteMap) []string {
+		var pages []string
+		for path, p := range sm.pages {
+			pages = append(pages, strings.Join([]string{path, p.url.String(), http.StatusText(p.status)}, " "))
+		}
+		sort.Strings(pages)
+		return pages
+	}
+	if got, want := summary(replay), summary(sm); !reflect.DeepEqual(got, want) {
+		t.Errorf("Replay got pages\n%v\nwant\n%v", got, want)
+	}
+}
+
+func TestStartWARCRecordSecrets(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "warc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.WARCPrefix = filepath.Join(dir, "crawl")
+	sm.Username, sm.Password = "user", "secret-password"
+	sm.Header = http.Header{"X-Api-Key": {"secret-key"}}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatalf("Start error: %v", err)
+	}
+
+	files, err := filepath.Glob(sm.WARCPrefix + "-*.warc.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) == 0 {
+		t.Fatal("No WARC files written")
+	}
+	for _, name := range files {
+		f, err := os.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archive, err := ioutil.ReadAll(zr)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(archive), "WARC-Type: request") {
+			t.Errorf("%s has no request records", name)
+		}
+		for _, secret := range []string{"Authorization:", "X-Api-Key:", "secret-key"} {
+			if strings.Contains(string(archive), secret) {
+				t.Errorf("%s contains %q", name, secret)
+			}
+		}
+	}
+}
+
+func TestNewRecordID(t *testing.T) {
+	a, b := newRecordID(), newRecordID()
+	if a == b {
+		t.Errorf("Got the same record ID %s twice", a)
+	}
+	if !strings.HasPrefix(a, "<urn:uuid:") || len(a) != len("<urn:uuid:00000000-0000-4000-8000-000000000000>") {
+		t.Errorf("Got invalid record ID %s", a)
+	}
+}
@@ -0,0 +1,237 @@
+package mapper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/xml"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The limits for a single sitemap file from sitemaps.org.
+const (
+	sitemapMaxURLs  = 50000
+	sitemapMaxBytes = 50 * 1024 * 1024
+)
+
+const (
+	sitemapName   = "sitemap.xml"
+	sitemapXMLNS  = "http://www.sitemaps.org/schemas/sitemap/0.9"
+	sitemapHeader = xml.Header + `<urlset xmlns="` + sitemapXMLNS + `">` + "\n"
+	sitemapFooter = "</urlset>\n"
+	indexHeader   = xml.Header + `<sitemapindex xmlns="` + sitemapXMLNS + `">` + "\n"
+	indexFooter   = "</sitemapindex>\n"
+)
+
+// XMLSitemapOptions configures the sitemaps.org XML sitemaps built from a
+// SiteMap.
+type XMLSitemapOptions struct {
+	// BaseURL is where the sitemap files will be published, it is used for
+	// the locations in a sitemap index. The site root is used if empty.
+	BaseURL string
+	// ChangeFreq adds a changefreq to each URL based on its click depth.
+	ChangeFreq bool
+	// Priority adds a priority to each URL based on its click depth.
+	Priority bool
+	// Gzip compresses each file, adding .gz to the file names.
+	Gzip bool
+	// MaxURLs and MaxBytes limit the size of each sitemap file, the
+	// sitemaps.org limits are used if they are 0.
+	MaxURLs  int
+	MaxBytes int
+}
+
+// XMLSitemaps builds sitemaps.org XML sitemaps of the pages successfully
+// crawled in sm, returning the file contents keyed by file name. When all
+// pages fit within a single file it is named sitemap.xml, otherwise the pages
+// are split into sitemap-1.xml, sitemap-2.xml, etc. and sitemap.xml is a
+// sitemap index listing them.
+func (sm *SiteMap) XMLSitemaps(opts XMLSitemapOptions) (map[string][]byte, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	maxURLs := opts.MaxURLs
+	if maxURLs <= 0 || maxURLs > sitemapMaxURLs {
+		maxURLs = sitemapMaxURLs
+	}
+	maxBytes := opts.MaxBytes
+	if maxBytes <= 0 || maxBytes > sitemapMaxBytes {
+		maxBytes = sitemapMaxBytes
+	}
+	overhead := len(sitemapHeader) + len(sitemapFooter)
+
+	var sitemaps []*bytes.Buffer
+	var current *bytes.Buffer
+	var count int
+	for _, entry := range sm.sitemapEntries(opts) {
+		if current == nil || count >= maxURLs || current.Len()+len(entry)+len(sitemapFooter) > maxBytes {
+			if overhead+len(entry) > maxBytes {
+				return nil, fmt.Errorf("sitemap entry of %d bytes does not fit within %d bytes", len(entry), maxBytes)
+			}
+			if current != nil {
+				current.WriteString(sitemapFooter)
+			}
+			current = bytes.NewBufferString(sitemapHeader)
+			sitemaps = append(sitemaps, current)
+			count = 0
+		}
+		current.WriteString(entry)
+		count++
+	}
+	if current == nil {
+		current = bytes.NewBufferString(sitemapHeader)
+		sitemaps = append(sitemaps, current)
+	}
+	current.WriteString(sitemapFooter)
+
+	ext := ""
+	if opts.Gzip {
+		ext = ".gz"
+	}
+	files := map[string][]byte{}
+	if len(sitemaps) == 1 {
+		files[sitemapName+ext] = sitemaps[0].Bytes()
+	} else {
+		base := sm.URL.ResolveReference(&url.URL{Path: "/"})
+		if opts.BaseURL != "" {
+			var err error
+			if base, err = url.Parse(opts.BaseURL); err != nil {
+				return nil, fmt.Errorf("invalid sitemap base URL %q: %v", opts.BaseURL, err)
+			}
+			if !strings.HasSuffix(base.Path, "/") {
+				base.Path += "/"
+			}
+		}
+		now := time.Now().UTC().Format(time.RFC3339)
+		index := bytes.NewBufferString(indexHeader)
+		for i, sitemap := range sitemaps {
+			name := fmt.Sprintf("sitemap-%d.xml%s", i+1, ext)
+			files[name] = sitemap.Bytes()
+			loc := base.ResolveReference(&url.URL{Path: name})
+			fmt.Fprintf(index, "<sitemap><loc>%s</loc><lastmod>%s</lastmod></sitemap>\n", xmlEscape(loc.String()), now)
+		}
+		index.WriteString(indexFooter)
+		files[sitemapName+ext] = index.Bytes()
+	}
+
+	if opts.Gzip {
+		for name, content := range files {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			if _, err := zw.Write(content); err != nil {
+				return nil, err
+			}
+			if err := zw.Close(); err != nil {
+				return nil, err
+			}
+			files[name] = buf.Bytes()
+		}
+	}
+	return files, nil
+}
+
+// sitemapEntries returns the url elements for every page crawled without
+// error, sorted by path. Pages redirecting to another page, skipped pages,
+// resources and pages declaring another canonical URL are not included. A
+// page redirecting to itself, such as to add a trailing slash, is listed by
+// the URL it redirects to.
+// The caller must hold sm.mu.
+func (sm *SiteMap) sitemapEntries(opts XMLSitemapOptions) []string {
+	depths := sm.depths()
+	sites := sm.hosts()
+	var paths []string
+	for path, p := range sm.pages {
+		// a sitemap may only list URLs on its own site
+		if siteHost(path) == "" && p.visited && !p.broken && !p.resource && p.skipped == "" && !p.redirected(&sm.Normalization, sites) && !p.nonCanonical(&sm.Normalization, sites) {
+			paths = append(paths, path)
+		}
+	}
+	sort.Strings(paths)
+
+	entries := make([]string, 0, len(paths))
+	for _, path := range paths {
+		p := sm.pages[path]
+		loc := p.url
+		if p.finalURL != nil {
+			loc = p.finalURL
+		}
+		entry := "<url><loc>" + xmlEscape(loc.String()) + "</loc>"
+		if modified, err := http.ParseTime(p.header.Get("Last-Modified")); err == nil {
+			entry += "<lastmod>" + modified.UTC().Format(time.RFC3339) + "</lastmod>"
+		}
+		if depth, ok := depths[path]; ok {
+			if opts.ChangeFreq {
+				entry += "<changefreq>" + depthChangeFreq(depth) + "</changefreq>"
+			}
+			if opts.Priority {
+				entry += fmt.Sprintf("<priority>%.1f</priority>", depthPriority(depth))
+			}
+		}
+		entries = append(entries, entry+"</url>\n")
+	}
+	return entries
+}
+
+// depthChangeFreq returns the expected change frequency for a page based on
+// its click depth, pages closer to the start page are assumed to change more.
+func depthChangeFreq(depth int) string {
+	switch depth {
+	case 0:
+		return "daily"
+	case 1:
+		return "weekly"
+	}
+	return "monthly"
+}
+
+// depthPriority returns a sitemap priority reduced by 0.2 for each click
+// from the start page with a minimum of 0.1.
+func depthPriority(depth int) float64 {
+	priority := 1.0 - 0.2*float64(depth)
+	if priority < 0.1 {
+		return 0.1
+	}
+	return priority
+}
+
+// xmlEscape returns s escaped for use as XML character data.
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// XMLSitemapHandler returns an http.Handler serving the XML sitemap files
+// built with opts. The file is chosen by the last element of the request
+// path with sitemap.xml served for a request ending in "/".
+func (sm *SiteMap) XMLSitemapHandler(opts XMLSitemapOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		files, err := sm.XMLSitemaps(opts)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to build sitemap: %v", err), http.StatusInternalServerError)
+			return
+		}
+		name := path.Base(r.URL.Path)
+		if strings.HasSuffix(r.URL.Path, "/") {
+			name = sitemapName
+			if opts.Gzip {
+				name += ".gz"
+			}
+		}
+		content, ok := files[name]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if opts.Gzip {
+			w.Header().Set("Content-Type", "application/gzip")
+		} else {
+			w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+		}
+		w.Write(content)
+	})
+}
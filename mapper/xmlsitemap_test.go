@@ -0,0 +1,224 @@
+package mapper
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type testURLSet struct {
+	URLs []struct {
+		Loc        string `xml:"loc"`
+		LastMod    string `xml:"lastmod"`
+		ChangeFreq string `xml:"changefreq"`
+		Priority   string `xml:"priority"`
+	} `xml:"url"`
+}
+
+// newCrawledSiteMap returns a SiteMap which has crawled the testdata starting
+// from /hello-world.
+func newCrawledSiteMap(t *testing.T, server *httptest.Server) *SiteMap {
+	sm, err := NewSiteMap(server.URL+"/hello-world", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return sm
+}
+
+func TestXMLSitemaps(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	sm := newCrawledSiteMap(t, server)
+
+	files, err := sm.XMLSitemaps(XMLSitemapOptions{ChangeFreq: true, Priority: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Got %d files, want 1", len(files))
+	}
+
+	var urlset testURLSet
+	if err := xml.Unmarshal(files["sitemap.xml"], &urlset); err != nil {
+		t.Fatal(err)
+	}
+	wantLocs := []string{server.URL + "/", server.URL + "/hello-world", server.URL + "/values", server.URL + "/variables"}
+	var locs []string
+	for _, u := range urlset.URLs {
+		locs = append(locs, u.Loc)
+		switch u.Loc {
+		case server.URL + "/hello-world":
+			if u.ChangeFreq != "daily" || u.Priority != "1.0" {
+				t.Errorf("Start page got changefreq %q and priority %q", u.ChangeFreq, u.Priority)
+			}
+			if u.LastMod == "" {
+				t.Error("Start page missing lastmod")
+			}
+		case server.URL + "/variables":
+			if u.ChangeFreq != "monthly" || u.Priority != "0.6" {
+				t.Errorf("Depth 2 page got changefreq %q and priority %q", u.ChangeFreq, u.Priority)
+			}
+		}
+	}
+	if !reflect.DeepEqual(locs, wantLocs) {
+		t.Errorf("Got locs %v, want %v", locs, wantLocs)
+	}
+}
+
+func TestXMLSitemapsFindings(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	sm := newCrawledSiteMap(t, server)
+	sm.pages["/"].findings = []string{"links with a different scheme than http: 1"}
+	sm.pages["/values"].canonical = server.URL + "/variables"
+	// a canonical URL normalized to the page itself is not another page
+	sm.Normalization = Normalizer{FoldTrailingSlash: true}
+	sm.pages["/variables"].canonical = server.URL + "/variables/"
+
+	files, err := sm.XMLSitemaps(XMLSitemapOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urlset testURLSet
+	if err := xml.Unmarshal(files["sitemap.xml"], &urlset); err != nil {
+		t.Fatal(err)
+	}
+	var locs []string
+	for _, u := range urlset.URLs {
+		locs = append(locs, u.Loc)
+	}
+	if want := []string{server.URL + "/", server.URL + "/hello-world", server.URL + "/variables"}; !reflect.DeepEqual(locs, want) {
+		t.Errorf("Got locs %v, want %v", locs, want)
+	}
+}
+
+func TestXMLSitemapsRedirects(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/docs", http.RedirectHandler("/docs/", http.StatusMovedPermanently))
+	mux.HandleFunc("/docs/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Write([]byte(`<a href="/moved">moved</a><a href="/away">away</a>`))
+	})
+	mux.Handle("/moved", http.RedirectHandler("/docs/", http.StatusMovedPermanently))
+	mux.Handle("/away", http.RedirectHandler("http://elsewhere.test/", http.StatusMovedPermanently))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	sm, err := NewSiteMap(server.URL+"/docs", 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sm.IgnoreRobots = true
+	sm.Normalization = Normalizer{FoldTrailingSlash: true}
+	if err := sm.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	files, err := sm.XMLSitemaps(XMLSitemapOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var urlset testURLSet
+	if err := xml.Unmarshal(files["sitemap.xml"], &urlset); err != nil {
+		t.Fatal(err)
+	}
+	var locs []string
+	for _, u := range urlset.URLs {
+		locs = append(locs, u.Loc)
+	}
+	// the page redirecting to itself is listed by its final URL
+	if want := []string{server.URL + "/docs/"}; !reflect.DeepEqual(locs, want) {
+		t.Errorf("Got locs %v, want %v", locs, want)
+	}
+}
+
+func TestXMLSitemapsSplit(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	sm := newCrawledSiteMap(t, server)
+
+	files, err := sm.XMLSitemaps(XMLSitemapOptions{BaseURL: "https://example.com/maps", Gzip: true, MaxURLs: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if want := []string{"sitemap-1.xml.gz", "sitemap-2.xml.gz", "sitemap.xml.gz"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("Got files %v, want %v", names, want)
+	}
+
+	gunzip := func(name string) []byte {
+		zr, err := gzip.NewReader(bytes.NewReader(files[name]))
+		if err != nil {
+			t.Fatalf("File %s: %v", name, err)
+		}
+		content, err := ioutil.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("File %s: %v", name, err)
+		}
+		return content
+	}
+
+	var index struct {
+		Sitemaps []sitemapLoc `xml:"sitemap"`
+	}
+	if err := xml.Unmarshal(gunzip("sitemap.xml.gz"), &index); err != nil {
+		t.Fatal(err)
+	}
+	wantIndex := []sitemapLoc{{Loc: "https://example.com/maps/sitemap-1.xml.gz"}, {Loc: "https://example.com/maps/sitemap-2.xml.gz"}}
+	if !reflect.DeepEqual(index.Sitemaps, wantIndex) {
+		t.Errorf("Got index %v, want %v", index.Sitemaps, wantIndex)
+	}
+
+	for name, want := range map[string]int{"sitemap-1.xml.gz": 3, "sitemap-2.xml.gz": 1} {
+		var urlset testURLSet
+		if err := xml.Unmarshal(gunzip(name), &urlset); err != nil {
+			t.Fatal(err)
+		}
+		if len(urlset.URLs) != want {
+			t.Errorf("File %s got %d urls, want %d", name, len(urlset.URLs), want)
+		}
+	}
+
+	files, err = sm.XMLSitemaps(XMLSitemapOptions{MaxBytes: len(sitemapHeader) + len(sitemapFooter) + 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 5 {
+		t.Errorf("Got %d files split by size, want 5", len(files))
+	}
+	if _, err := sm.XMLSitemaps(XMLSitemapOptions{MaxBytes: 10}); err == nil {
+		t.Error("Got nil error for entries larger than MaxBytes")
+	}
+}
+
+func TestXMLSitemapHandler(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer server.Close()
+	sm := newCrawledSiteMap(t, server)
+
+	h := sm.XMLSitemapHandler(XMLSitemapOptions{})
+	for path, wantStatus := range map[string]int{"/sitemap.xml": 200, "/sitemaps/": 200, "/sitemap-1.xml": 404} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != wantStatus {
+			t.Errorf("Path %q got status %d, want %d", path, w.Code, wantStatus)
+		}
+		if wantStatus == 200 && !strings.Contains(w.Body.String(), "<urlset") {
+			t.Errorf("Path %q got body %s", path, w.Body.String())
+		}
+	}
+}